@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// allowListPath is the system-wide allow-list of commands that Watch
+// may run. If it exists, no other command is run. It is a variable so
+// that packagers can set it with -ldflags -X, but there is deliberately
+// no flag or environment variable to override it.
+var allowListPath = "/etc/watch/allow"
+
+// allowList holds the patterns read from allowListPath,
+// or nil if there is no allow-list.
+var allowList []string
+
+// loadAllowList reads the allow-list, which has a shell glob
+// matching the absolute paths of allowed executables on each line.
+// Blank lines and lines starting with # are ignored.
+func loadAllowList() error {
+	f, err := os.Open(allowListPath)
+	switch {
+	case os.IsNotExist(err):
+		return nil
+	case err != nil:
+		return fmt.Errorf("Failed to read the allow-list: %s", err)
+	}
+	defer f.Close()
+
+	allowList = []string{}
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		l := strings.TrimSpace(s.Text())
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+		if _, err := filepath.Match(l, ""); err != nil || !filepath.IsAbs(l) {
+			return fmt.Errorf("%s:%d: bad pattern %q: patterns must be absolute paths", allowListPath, n, l)
+		}
+		allowList = append(allowList, l)
+	}
+	return s.Err()
+}
+
+// checkAllowed returns an error unless the allow-list permits running
+// the executable named by name, found on $PATH if it has no slashes.
+// Symbolic links are resolved, so that a link to an allowed command
+// cannot be used to run something else.
+func checkAllowed(name string) error {
+	if allowList == nil {
+		return nil
+	}
+	p, err := exec.LookPath(name)
+	if err != nil {
+		return err
+	}
+	if p, err = filepath.Abs(p); err != nil {
+		return err
+	}
+	if p, err = filepath.EvalSymlinks(p); err != nil {
+		return err
+	}
+	for _, pat := range allowList {
+		if ok, _ := filepath.Match(pat, p); ok {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s is not in the allow-list %s", p, allowListPath)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+var appendFiles = flag.Bool("a", false, "Append the changed files to the command's arguments")
+
+// expandArgs replaces the tokens in the command's arguments with details
+// of the latest change: %f with the changed file, %d with its directory,
+// and %e with the event, such as write or create. %F is replaced with
+// list, the file listing all the changed files, and %% with a percent
+// sign. Without changes, as on start, the tokens expand to nothing, and
+// arguments that were just a token are dropped. With -a, the changed
+// files are appended.
+func expandArgs(args []string, changes []change, list string) []string {
+	var f, d, e string
+	if len(changes) > 0 {
+		c := changes[len(changes)-1]
+		f, d, e = c.path, filepath.Dir(c.path), strings.ToLower(c.op.String())
+	}
+	r := strings.NewReplacer("%%", "%", "%f", f, "%d", d, "%e", e, "%F", list)
+	out := make([]string, 0, len(args))
+	for i, a := range args {
+		x := r.Replace(a)
+		if i > 0 && x == "" && a != "" {
+			continue
+		}
+		out = append(out, x)
+	}
+	if *appendFiles {
+		out = append(out, (runResult{changes: changes}).files()...)
+	}
+	return out
+}
+
+// needsList reports whether the arguments use %F.
+func needsList(args []string) bool {
+	for _, a := range args {
+		if strings.Contains(strings.Replace(a, "%%", "", -1), "%F") {
+			return true
+		}
+	}
+	return false
+}
+
+// writeList writes the changed files to a temporary file, one per line,
+// and returns its name.
+func writeList(changes []change) (string, error) {
+	f, err := ioutil.TempFile("", "watch-files-")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	for _, p := range (runResult{changes: changes}).files() {
+		if _, err := fmt.Fprintln(f, p); err != nil {
+			os.Remove(f.Name())
+			return "", err
+		}
+	}
+	return f.Name(), nil
+}
+
+// runEnv returns the variables describing the run that are added to the
+// command's environment: WATCH_CHANGED_FILE and WATCH_EVENT_OP for the
+// latest change, WATCH_CHANGE_COUNT for the number of changed files,
+// and WATCH_LINE with -trigger-stdin.
+func runEnv(r runResult) []string {
+	var f, op string
+	if len(r.changes) > 0 {
+		c := r.changes[len(r.changes)-1]
+		f, op = c.path, strings.ToLower(c.op.String())
+	}
+	env := []string{
+		"WATCH_CHANGED_FILE=" + f,
+		"WATCH_EVENT_OP=" + op,
+		"WATCH_CHANGE_COUNT=" + strconv.Itoa(len(r.files())),
+	}
+	if r.reason == "stdin" {
+		env = append(env, "WATCH_LINE="+r.line)
+	}
+	return env
+}
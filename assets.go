@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+)
+
+var (
+	assetDir      = flag.String("assets", "", "After each successful run, fingerprint the files in this directory of built assets")
+	assetManifest = flag.String("asset-manifest", "", "Where to write the manifest of fingerprinted assets (default: manifest.json in -assets)")
+)
+
+// fingerprintRe matches the names of fingerprinted copies of assets.
+var fingerprintRe = regexp.MustCompile(`\.[0-9a-f]{8}(\.[^./]*)?$`)
+
+// An assetPipeline fingerprints the built assets after each successful
+// run: it copies each to a name with a hash of its contents, writes a
+// manifest mapping the names to the copies, and tells reload clients
+// which assets changed.
+type assetPipeline struct {
+	dir, manifest string
+	// hashed is the fingerprinted name of each asset after the last run.
+	hashed map[string]string
+}
+
+func newAssetPipeline() (reporter, error) {
+	if *reloadAddr != "" {
+		if err := startReloadServer(); err != nil {
+			return nil, err
+		}
+	}
+	if *assetDir == "" {
+		if reloads != nil {
+			return reloadReporter{}, nil
+		}
+		return nil, nil
+	}
+	a := &assetPipeline{dir: filepath.Clean(*assetDir), manifest: *assetManifest, hashed: make(map[string]string)}
+	if a.manifest == "" {
+		a.manifest = filepath.Join(a.dir, "manifest.json")
+	}
+	addOwnFile(a.manifest)
+	return a, nil
+}
+
+// isAssetOutput reports whether p is written by the build or the asset
+// pipeline, and so must not trigger runs.
+func isAssetOutput(p string) bool {
+	return *assetDir != "" && within(p, filepath.Clean(*assetDir))
+}
+
+func (a *assetPipeline) started(r runResult) {}
+
+func (a *assetPipeline) finished(r runResult) {
+	if r.status != 0 {
+		return
+	}
+	changed, err := a.fingerprint()
+	if err != nil {
+		log.Printf("Failed to fingerprint assets: %s", err)
+		return
+	}
+	if reloads != nil && len(changed) > 0 {
+		m := reloadMessage{Changed: changed, Assets: make(map[string]string)}
+		for _, p := range changed {
+			m.Assets[p] = a.hashed[p]
+		}
+		reloads.send(m)
+	}
+}
+
+// fingerprint copies the assets to their fingerprinted names and writes
+// the manifest. It returns the names of the assets that changed.
+func (a *assetPipeline) fingerprint() ([]string, error) {
+	hashed := make(map[string]string)
+	err := filepath.Walk(a.dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() || fingerprintRe.MatchString(p) || p == a.manifest {
+			return nil
+		}
+		b, err := ioutil.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(a.dir, p)
+		if err != nil {
+			return err
+		}
+		ext, h := filepath.Ext(rel), sha256.Sum256(b)
+		name := fmt.Sprintf("%s.%x%s", rel[:len(rel)-len(ext)], h[:4], ext)
+		hashed[filepath.ToSlash(rel)] = filepath.ToSlash(name)
+		dst := filepath.Join(a.dir, name)
+		if _, err := os.Stat(dst); err == nil {
+			return nil
+		}
+		return ioutil.WriteFile(dst, b, fi.Mode().Perm())
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var changed []string
+	for rel, name := range hashed {
+		if a.hashed[rel] != name {
+			changed = append(changed, rel)
+		}
+	}
+	sort.Strings(changed)
+	a.hashed = hashed
+
+	b, err := json.MarshalIndent(hashed, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return changed, writeFileAtomic(a.manifest, append(b, '\n'))
+}
+
+// A reloadReporter tells reload clients about the changed files after
+// each successful run, when there is no asset pipeline to tell them.
+type reloadReporter struct{}
+
+func (reloadReporter) started(r runResult) {}
+
+func (reloadReporter) finished(r runResult) {
+	if r.status == 0 {
+		reloads.send(reloadMessage{Changed: r.files()})
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/user"
+	"strings"
+	"time"
+)
+
+var (
+	auditPath = flag.String("audit", "", "Append a JSON record of every command execution to this file")
+	auditEnv  = flag.String("audit-env", "PATH", "Comma-separated environment variables to record in the audit log")
+)
+
+// An auditRecord is a line of the audit log.
+type auditRecord struct {
+	Time   time.Time         `json:"time"`
+	Event  string            `json:"event"` // start or exit
+	Argv   []string          `json:"argv"`
+	Rule   string            `json:"rule,omitempty"`
+	Dir    string            `json:"dir"`
+	Env    map[string]string `json:"env,omitempty"`
+	Reason string            `json:"reason,omitempty"`
+	Files  []string          `json:"files,omitempty"`
+	User   string            `json:"user"`
+	UID    int               `json:"uid"`
+	Pid    int               `json:"watch_pid"`
+	Status *int              `json:"exit_status,omitempty"`
+}
+
+// An auditLog records command executions to an append-only file.
+type auditLog struct {
+	f    *os.File
+	dir  string
+	user string
+	env  []string
+}
+
+// runAudit is the audit log, if there is one.
+var runAudit *auditLog
+
+// newAuditLog returns an auditLog for the -audit flag,
+// or nil if no audit log was requested.
+func newAuditLog() (reporter, error) {
+	if *auditPath == "" {
+		return nil, nil
+	}
+	f, err := os.OpenFile(*auditPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open audit log: %s", err)
+	}
+	addOwnFile(*auditPath)
+	dir, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+	a := &auditLog{f: f, dir: dir}
+	if u, err := user.Current(); err == nil {
+		a.user = u.Username
+	}
+	for _, e := range strings.Split(*auditEnv, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			a.env = append(a.env, e)
+		}
+	}
+	runAudit = a
+	return a, nil
+}
+
+func (a *auditLog) record(r runResult, event string) auditRecord {
+	rec := auditRecord{
+		Time:   time.Now(),
+		Event:  event,
+		Argv:   r.args,
+		Rule:   r.rule,
+		Dir:    a.dir,
+		Reason: r.reason,
+		User:   a.user,
+		UID:    os.Getuid(),
+		Pid:    os.Getpid(),
+	}
+	for _, e := range a.env {
+		if v, ok := os.LookupEnv(e); ok {
+			if rec.Env == nil {
+				rec.Env = make(map[string]string)
+			}
+			rec.Env[e] = v
+		}
+	}
+	return rec
+}
+
+func (a *auditLog) started(r runResult) {
+	rec := a.record(r, "start")
+	rec.Files = r.files()
+	a.write(rec)
+}
+
+func (a *auditLog) finished(r runResult) {
+	rec := a.record(r, "exit")
+	rec.Env = nil
+	rec.Status = &r.status
+	a.write(rec)
+}
+
+// write appends rec to the log in a single write,
+// so that concurrent sessions never interleave records.
+func (a *auditLog) write(rec auditRecord) {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		log.Printf("Failed to encode audit record: %s", err)
+		return
+	}
+	if _, err := a.f.Write(append(b, '\n')); err != nil {
+		log.Printf("Failed to write audit log: %s", err)
+	}
+}
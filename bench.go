@@ -0,0 +1,378 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+var (
+	benchMode      = flag.Bool("bench", false, "Compare the Go benchmark results in the command's output with those of the previous run; without a command, run go test -bench . -count 5 ./...")
+	benchThreshold = flag.Float64("bench-threshold", 5, "With -bench, the percentage by which a significant change for the worse is a regression")
+	benchAlert     = flag.Bool("bench-alert", false, "With -bench, notify the -notify webhooks when time/op, alloc/op or allocs/op regress from the pinned baseline, pinning the first results if there is none")
+)
+
+// benchAlpha is the p-value below which a change is significant.
+const benchAlpha = 0.05
+
+// defaultBenchArgs returns the command run with -bench and no command.
+func defaultBenchArgs() []string {
+	return []string{"go", "test", "-run", "^$", "-bench", ".", "-count", "5", "./..."}
+}
+
+// benchResults are the samples of each benchmark's measurements, by
+// benchmark and then by unit, such as ns/op.
+type benchResults map[string]map[string][]float64
+
+// parseBench returns the benchmark results in go test output. The names
+// of benchmarks are prefixed with their package's, if it is given.
+func parseBench(out []byte) benchResults {
+	res := make(benchResults)
+	var pkg string
+	sc := bufio.NewScanner(bytes.NewReader(out))
+	for sc.Scan() {
+		l := sc.Text()
+		if strings.HasPrefix(l, "pkg: ") {
+			pkg = filepath.Base(strings.TrimSpace(l[len("pkg: "):]))
+			continue
+		}
+		f := strings.Fields(l)
+		if len(f) < 4 || !strings.HasPrefix(f[0], "Benchmark") || len(f)%2 != 0 {
+			continue
+		}
+		if _, err := strconv.Atoi(f[1]); err != nil {
+			continue
+		}
+		name := strings.TrimPrefix(f[0], "Benchmark")
+		if pkg != "" {
+			name = pkg + "." + name
+		}
+		for i := 2; i+1 < len(f); i += 2 {
+			v, err := strconv.ParseFloat(f[i], 64)
+			if err != nil {
+				break
+			}
+			if res[name] == nil {
+				res[name] = make(map[string][]float64)
+			}
+			res[name][f[i+1]] = append(res[name][f[i+1]], v)
+		}
+	}
+	return res
+}
+
+// benchState is what is kept between runs in the project's state directory.
+type benchState struct {
+	Previous benchResults `json:"previous"`
+	// Baseline are the results pinned with watch bench pin.
+	Baseline benchResults `json:"baseline,omitempty"`
+}
+
+func benchStatePath() string {
+	dir, err := os.Getwd()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(projectStateDir(dir), "bench.json")
+}
+
+func loadBenchState() benchState {
+	var st benchState
+	if b, err := ioutil.ReadFile(benchStatePath()); err == nil {
+		json.Unmarshal(b, &st)
+	}
+	return st
+}
+
+func saveBenchState(st benchState) {
+	p := benchStatePath()
+	b, err := json.Marshal(st)
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(p), 0755)
+	}
+	if err == nil {
+		err = writeFileAtomic(p, b)
+	}
+	if err != nil {
+		log.Printf("Failed to save the benchmark results: %s", err)
+	}
+}
+
+// compareBench prints how the benchmark results of the run differ from
+// those of the previous run, and keeps them for the next.
+func compareBench(out io.Writer, r runResult) {
+	res := parseBench(r.stdout)
+	if len(res) == 0 {
+		return
+	}
+	st := loadBenchState()
+	if st.Previous != nil {
+		io.WriteString(out, "bench: compared with the previous run\n")
+		printBenchDeltas(out, st.Previous, res)
+	}
+	if *benchAlert {
+		checkBaseline(out, &st, res)
+	}
+	st.Previous = res
+	saveBenchState(st)
+}
+
+// benchAlerted are the regressions from the baseline already alerted
+// to, by benchmark and unit, so that each is only alerted to once
+// until it is fixed.
+var benchAlerted = make(map[string]bool)
+
+// checkBaseline prints the regressions from the pinned baseline in
+// time and allocations, and alerts to those that are new. Without a
+// baseline, it pins the results.
+func checkBaseline(out io.Writer, st *benchState, res benchResults) {
+	if st.Baseline == nil {
+		st.Baseline = res
+		io.WriteString(out, "bench: pinned these results as the baseline\n")
+		return
+	}
+	var msgs []string
+	regressed := make(map[string]bool)
+	for _, d := range benchDeltas(st.Baseline, res) {
+		switch d.unit {
+		case "ns/op", "B/op", "allocs/op":
+		default:
+			continue
+		}
+		if !d.regression() {
+			continue
+		}
+		key := d.name + " " + d.unit
+		regressed[key] = true
+		fmt.Fprintf(out, "bench: %s %s regressed %+.2f%% from the baseline\n", d.name, benchUnitName(d.unit), d.delta)
+		if !benchAlerted[key] {
+			msgs = append(msgs, fmt.Sprintf("%s %s %+.2f%% (%s → %s)", d.name, benchUnitName(d.unit), d.delta,
+				formatBenchValue(mean(d.old), d.unit), formatBenchValue(mean(d.new), d.unit)))
+		}
+	}
+	benchAlerted = regressed
+	if len(msgs) > 0 {
+		alert("Benchmarks regressed from the baseline: " + strings.Join(msgs, ", "))
+	}
+}
+
+// benchCmd manages the baseline that -bench-alert compares with:
+//
+//	watch bench pin     pins the results of the last run
+//	watch bench unpin   forgets the baseline
+func benchCmd(args []string) {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	fs.Parse(args)
+
+	st := loadBenchState()
+	switch fs.Arg(0) {
+	case "pin":
+		if st.Previous == nil {
+			log.Fatalln("No benchmark results to pin: run Watch with -bench first")
+		}
+		st.Baseline = st.Previous
+	case "unpin":
+		st.Baseline = nil
+	default:
+		log.Fatalln("usage: watch bench pin|unpin")
+	}
+	saveBenchState(st)
+}
+
+// A benchDelta is the change in one measurement of a benchmark.
+type benchDelta struct {
+	name, unit string
+	old, new   []float64
+	delta      float64 // the change in the mean, as a percentage
+	p          float64
+}
+
+// significant reports whether the change is unlikely to be noise.
+func (d benchDelta) significant() bool { return d.p < benchAlpha }
+
+// regression reports whether the change is significant, for the worse,
+// and larger than -bench-threshold.
+func (d benchDelta) regression() bool {
+	worse := d.delta
+	if d.unit == "MB/s" {
+		worse = -worse
+	}
+	return d.significant() && worse > *benchThreshold
+}
+
+// benchDeltas returns the changes in the measurements of the benchmarks
+// that are in both results, ordered by unit and then name.
+func benchDeltas(old, new benchResults) []benchDelta {
+	var ds []benchDelta
+	for name, units := range new {
+		for unit, nv := range units {
+			ov := old[name][unit]
+			if len(ov) == 0 {
+				continue
+			}
+			d := benchDelta{name: name, unit: unit, old: ov, new: nv, p: mannWhitney(ov, nv)}
+			if m := mean(ov); m != 0 {
+				d.delta = (mean(nv) - m) / m * 100
+			}
+			ds = append(ds, d)
+		}
+	}
+	sort.Slice(ds, func(i, j int) bool {
+		if ds[i].unit != ds[j].unit {
+			return benchUnitOrder(ds[i].unit) < benchUnitOrder(ds[j].unit)
+		}
+		return ds[i].name < ds[j].name
+	})
+	return ds
+}
+
+// printBenchDeltas prints a table of the changes for each unit, in the
+// manner of benchstat: changes that are not significant are shown as ~.
+func printBenchDeltas(out io.Writer, old, new benchResults) {
+	tw := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	unit := ""
+	for _, d := range benchDeltas(old, new) {
+		if d.unit != unit {
+			if unit != "" {
+				fmt.Fprintln(tw)
+			}
+			unit = d.unit
+			fmt.Fprintf(tw, "name\told %s\tnew %s\tdelta\n", benchUnitName(unit), benchUnitName(unit))
+		}
+		delta := "~"
+		if d.significant() {
+			delta = fmt.Sprintf("%+.2f%%", d.delta)
+		}
+		note := ""
+		if d.regression() {
+			note = "  REGRESSION"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t(p=%.3f n=%d+%d)%s\n", d.name,
+			formatSamples(d.old, unit), formatSamples(d.new, unit), delta, d.p, len(d.old), len(d.new), note)
+	}
+	tw.Flush()
+}
+
+// benchUnitName returns the name benchstat gives the unit.
+func benchUnitName(unit string) string {
+	switch unit {
+	case "ns/op":
+		return "time/op"
+	case "B/op":
+		return "alloc/op"
+	case "MB/s":
+		return "speed"
+	}
+	return unit
+}
+
+func benchUnitOrder(unit string) int {
+	switch unit {
+	case "ns/op":
+		return 0
+	case "MB/s":
+		return 1
+	case "B/op":
+		return 2
+	case "allocs/op":
+		return 3
+	}
+	return 4
+}
+
+// formatSamples formats the mean of the samples, with their spread
+// around it as a percentage.
+func formatSamples(v []float64, unit string) string {
+	m := mean(v)
+	spread := 0.0
+	for _, x := range v {
+		if m != 0 {
+			spread = math.Max(spread, math.Abs(x-m)/m*100)
+		}
+	}
+	return fmt.Sprintf("%s ± %.0f%%", formatBenchValue(m, unit), spread)
+}
+
+func formatBenchValue(v float64, unit string) string {
+	switch unit {
+	case "ns/op":
+		for _, u := range []struct {
+			scale float64
+			name  string
+		}{{1e9, "s"}, {1e6, "ms"}, {1e3, "µs"}} {
+			if v >= u.scale {
+				return fmt.Sprintf("%.3g%s", v/u.scale, u.name)
+			}
+		}
+		return fmt.Sprintf("%.3gns", v)
+	case "B/op":
+		return fmt.Sprintf("%.3gB", v)
+	case "MB/s":
+		return fmt.Sprintf("%.3gMB/s", v)
+	}
+	return fmt.Sprintf("%.3g", v)
+}
+
+func mean(v []float64) float64 {
+	var sum float64
+	for _, x := range v {
+		sum += x
+	}
+	return sum / float64(len(v))
+}
+
+// mannWhitney returns the two-sided p-value of the Mann-Whitney U test
+// of whether the samples come from the same distribution, using the
+// normal approximation with a continuity correction.
+func mannWhitney(a, b []float64) float64 {
+	type obs struct {
+		v     float64
+		first bool
+	}
+	all := make([]obs, 0, len(a)+len(b))
+	for _, x := range a {
+		all = append(all, obs{x, true})
+	}
+	for _, x := range b {
+		all = append(all, obs{x, false})
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].v < all[j].v })
+
+	// Sum the ranks of a, giving tied values their average rank.
+	var ra float64
+	for i := 0; i < len(all); {
+		j := i
+		for j < len(all) && all[j].v == all[i].v {
+			j++
+		}
+		rank := float64(i+j+1) / 2
+		for k := i; k < j; k++ {
+			if all[k].first {
+				ra += rank
+			}
+		}
+		i = j
+	}
+
+	n1, n2 := float64(len(a)), float64(len(b))
+	u := ra - n1*(n1+1)/2
+	mu := n1 * n2 / 2
+	sigma := math.Sqrt(n1 * n2 * (n1 + n2 + 1) / 12)
+	if sigma == 0 {
+		return 1
+	}
+	z := math.Max(math.Abs(u-mu)-0.5, 0) / sigma
+	return math.Erfc(z / math.Sqrt2)
+}
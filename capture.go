@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	captureRuns = flag.Bool("capture", false, "Record the command's environment, the git commit, and the versions of the -probe tools at each run, shown in the run's header and kept in the -history")
+	probeFlags  stringList
+)
+
+func init() {
+	flag.Var(&probeFlags, "probe", "With -capture, a tool version to record at each run, as name=command, such as 'go=go version' (default: go and node, if installed; may be repeated)")
+}
+
+// A probe is a command whose output is a tool's version.
+type probe struct {
+	name string
+	args []string
+}
+
+// probes are the parsed -probe flags, or the default probes for the
+// tools that are installed.
+var probes []probe
+
+// defaultProbes are the probes used when no -probe is given.
+var defaultProbes = []probe{
+	{"go", []string{"go", "version"}},
+	{"node", []string{"node", "-v"}},
+}
+
+// probeTimeout bounds how long probing may take.
+const probeTimeout = 5 * time.Second
+
+// secretNames are the parts of the names of environment variables whose
+// values are not recorded, as in GITHUB_TOKEN.
+var secretNames = []string{"TOKEN", "SECRET", "PASSWORD", "PASSWD", "KEY", "CREDENTIAL", "AUTH"}
+
+// setupProbes parses the -probe flags, which, like the command, must be
+// allowed by the allow-list. Default probes that are not are left out.
+func setupProbes() error {
+	if !*captureRuns {
+		if len(probeFlags) > 0 {
+			return fmt.Errorf("-probe needs -capture")
+		}
+		return nil
+	}
+	for _, f := range probeFlags {
+		i := strings.IndexByte(f, '=')
+		if i <= 0 || len(strings.Fields(f[i+1:])) == 0 {
+			return fmt.Errorf("invalid -probe %q: want name=command", f)
+		}
+		p := probe{f[:i], strings.Fields(f[i+1:])}
+		if err := checkAllowed(p.args[0]); err != nil {
+			return fmt.Errorf("-probe %s: %s", p.name, err)
+		}
+		probes = append(probes, p)
+	}
+	if len(probeFlags) == 0 {
+		for _, p := range defaultProbes {
+			if _, err := exec.LookPath(p.args[0]); err == nil && checkAllowed(p.args[0]) == nil {
+				probes = append(probes, p)
+			}
+		}
+	}
+	return nil
+}
+
+// A runCapture is the state of the toolchain and environment at a run.
+type runCapture struct {
+	Tools  []toolVersion `json:"tools,omitempty"`
+	Commit string        `json:"commit,omitempty"`
+	Dirty  bool          `json:"dirty,omitempty"`
+	// Env is the environment the command inherits, without the WATCH_
+	// variables describing each run, sorted, with the values of secrets
+	// redacted.
+	Env []string `json:"env,omitempty"`
+}
+
+// A toolVersion is the first line of a probe's output, or its error.
+type toolVersion struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+// captureRun runs the probes and asks git for the commit, concurrently,
+// and records env.
+func captureRun(ctx context.Context, env []string) *runCapture {
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+	c := &runCapture{Tools: make([]toolVersion, len(probes)), Env: redactEnv(env)}
+	var wg sync.WaitGroup
+	for i, p := range probes {
+		wg.Add(1)
+		go func(i int, p probe) {
+			defer wg.Done()
+			out, err := exec.CommandContext(ctx, p.args[0], p.args[1:]...).CombinedOutput()
+			v := firstLine(out)
+			if err != nil {
+				v = "failed: " + err.Error()
+			}
+			c.Tools[i] = toolVersion{p.name, v}
+		}(i, p)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		out, err := exec.CommandContext(ctx, "git", "rev-parse", "HEAD").Output()
+		if err != nil {
+			return
+		}
+		c.Commit = firstLine(out)
+		out, err = exec.CommandContext(ctx, "git", "status", "--porcelain", "--untracked-files=no").Output()
+		c.Dirty = err == nil && len(bytes.TrimSpace(out)) > 0
+	}()
+	wg.Wait()
+	return c
+}
+
+func firstLine(b []byte) string {
+	s := strings.TrimSpace(string(b))
+	if i := strings.IndexByte(s, '\n'); i >= 0 {
+		s = s[:i]
+	}
+	return s
+}
+
+// redactEnv returns env sorted, with the values of secrets replaced.
+func redactEnv(env []string) []string {
+	r := make([]string, 0, len(env))
+	for _, kv := range env {
+		i := strings.IndexByte(kv, '=')
+		if i < 0 {
+			i = len(kv)
+		}
+		name := strings.ToUpper(kv[:i])
+		for _, s := range secretNames {
+			if strings.Contains(name, s) {
+				kv = kv[:i] + "=<redacted>"
+				break
+			}
+		}
+		r = append(r, kv)
+	}
+	sort.Strings(r)
+	return r
+}
+
+// envHash identifies the environment in the header, to tell when it changed.
+func (c *runCapture) envHash() string {
+	h := sha256.Sum256([]byte(strings.Join(c.Env, "\x00")))
+	return fmt.Sprintf("%x", h[:4])
+}
+
+// header sums up the capture in a line, to follow the command's.
+func (c *runCapture) header() string {
+	var parts []string
+	for _, t := range c.Tools {
+		parts = append(parts, t.Name+": "+t.Version)
+	}
+	if c.Commit != "" {
+		commit := c.Commit
+		if len(commit) > 12 {
+			commit = commit[:12]
+		}
+		if c.Dirty {
+			commit += " (dirty)"
+		}
+		parts = append(parts, "git: "+commit)
+	}
+	parts = append(parts, "env: "+c.envHash())
+	return strings.Join(parts, ", ")
+}
+
+// lines lists what was captured, a line for each tool, the commit, and
+// each environment variable, for comparing runs.
+func (c *runCapture) lines() []string {
+	if c == nil {
+		return nil
+	}
+	var l []string
+	for _, t := range c.Tools {
+		l = append(l, t.Name+": "+t.Version)
+	}
+	if c.Commit != "" {
+		commit := "git: " + c.Commit
+		if c.Dirty {
+			commit += " (dirty)"
+		}
+		l = append(l, commit)
+	}
+	for _, kv := range c.Env {
+		l = append(l, "env: "+kv)
+	}
+	return l
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"strconv"
+	"strings"
+)
+
+var (
+	memoryMax = flag.String("memory-max", "", "Limit the command's memory use, e.g. 2G, by running it in its own cgroup (Linux cgroup v2 only)")
+	cpuMax    = flag.Float64("cpu-max", 0, "Limit the command's CPU use to this many CPUs, e.g. 1.5, by running it in its own cgroup (Linux cgroup v2 only)")
+)
+
+// parseSize parses a size in bytes with an optional K, M, G,
+// or T suffix, each 1024 times the previous one.
+func parseSize(s string) (int64, error) {
+	t := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "B")
+	mult := int64(1)
+	if n := len(t); n > 0 {
+		if i := strings.IndexByte("KMGT", t[n-1]); i >= 0 {
+			mult = 1 << (10 * uint(i+1))
+			t = t[:n-1]
+		}
+	}
+	n, err := strconv.ParseFloat(t, 64)
+	if err != nil || n < 0 {
+		return 0, errors.New("bad size: " + s)
+	}
+	return int64(n * float64(mult)), nil
+}
@@ -0,0 +1,155 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// cpuPeriod is the cpu.max period, in microseconds.
+const cpuPeriod = 100000
+
+// newCgroup creates the cgroup in which the command runs with
+// the -memory-max and -cpu-max limits, and returns its path,
+// or "" if there are no limits. The cgroup is removed on exit.
+//
+// The cgroup is a sibling of a new leaf cgroup for Watch itself,
+// since cgroup v2 only lets cgroups without processes of their own
+// enable controllers for their children.
+func newCgroup() (string, error) {
+	if *memoryMax == "" && *cpuMax == 0 {
+		return "", nil
+	}
+	limits := make(map[string]string)
+	if *memoryMax != "" {
+		n, err := parseSize(*memoryMax)
+		if err != nil {
+			return "", err
+		}
+		limits["memory.max"] = strconv.FormatInt(n, 10)
+		// Kill the whole command, not just its biggest process.
+		limits["memory.oom.group"] = "1"
+	}
+	if *cpuMax < 0 {
+		return "", errors.New("-cpu-max must be positive")
+	}
+	if *cpuMax > 0 {
+		limits["cpu.max"] = fmt.Sprintf("%d %d", int(*cpuMax*cpuPeriod), cpuPeriod)
+	}
+
+	mnt, err := cgroup2Mount()
+	if err != nil {
+		return "", err
+	}
+	self, err := ownCgroup()
+	if err != nil {
+		return "", err
+	}
+	parent := filepath.Join(mnt, self)
+	var controllers []string
+	for file := range limits {
+		c := "+" + strings.SplitN(file, ".", 2)[0]
+		if !contains(controllers, c) {
+			controllers = append(controllers, c)
+		}
+	}
+	enable := func() error {
+		return ioutil.WriteFile(filepath.Join(parent, "cgroup.subtree_control"), []byte(strings.Join(controllers, " ")), 0)
+	}
+	if err := enable(); err != nil {
+		if pe, ok := err.(*os.PathError); !ok || pe.Err != syscall.EBUSY {
+			return "", fmt.Errorf("Failed to enable cgroup controllers in %s: %s", parent, err)
+		}
+		leaf := filepath.Join(parent, fmt.Sprintf("watch-%d", os.Getpid()))
+		if err := os.Mkdir(leaf, 0755); err != nil {
+			return "", fmt.Errorf("Failed to create cgroup: %s", err)
+		}
+		atExit(func() { moveBack(parent, leaf) })
+		if err := writePid(leaf, os.Getpid()); err != nil {
+			return "", fmt.Errorf("Failed to move Watch to its own cgroup: %s", err)
+		}
+		if err := enable(); err != nil {
+			return "", fmt.Errorf("Failed to enable cgroup controllers in %s, which has other processes: %s", parent, err)
+		}
+	}
+
+	cg := filepath.Join(parent, fmt.Sprintf("watch-%d-command", os.Getpid()))
+	if err := os.Mkdir(cg, 0755); err != nil {
+		return "", fmt.Errorf("Failed to create cgroup: %s", err)
+	}
+	atExit(func() { os.Remove(cg) })
+	for file, v := range limits {
+		if err := ioutil.WriteFile(filepath.Join(cg, file), []byte(v), 0); err != nil {
+			return "", fmt.Errorf("Failed to set %s: %s", file, err)
+		}
+	}
+	debugPrint("Running the command in cgroup %s", cg)
+	return cg, nil
+}
+
+// moveBack moves Watch from leaf back to parent, and removes leaf.
+func moveBack(parent, leaf string) {
+	writePid(parent, os.Getpid())
+	os.Remove(leaf)
+}
+
+// joinCgroup moves the calling process into the cgroup at path.
+func joinCgroup(path string) error {
+	return writePid(path, os.Getpid())
+}
+
+func writePid(cgroup string, pid int) error {
+	return ioutil.WriteFile(filepath.Join(cgroup, "cgroup.procs"), []byte(strconv.Itoa(pid)), 0)
+}
+
+// cgroup2Mount returns where the cgroup v2 hierarchy is mounted.
+func cgroup2Mount() (string, error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		// The file system type follows the " - " separator.
+		fields := strings.Fields(s.Text())
+		for i, f := range fields {
+			if f == "-" && i+1 < len(fields) && fields[i+1] == "cgroup2" && len(fields) > 4 {
+				return fields[4], nil
+			}
+		}
+	}
+	return "", errors.New("cgroup v2 is not mounted")
+}
+
+// ownCgroup returns the cgroup v2 path of Watch itself.
+func ownCgroup() (string, error) {
+	b, err := ioutil.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return "", err
+	}
+	for _, l := range strings.Split(string(b), "\n") {
+		if strings.HasPrefix(l, "0::") {
+			return l[len("0::"):], nil
+		}
+	}
+	return "", errors.New("not in a cgroup v2 hierarchy")
+}
+
+func contains(l []string, s string) bool {
+	for _, e := range l {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
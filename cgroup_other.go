@@ -0,0 +1,17 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "errors"
+
+func newCgroup() (string, error) {
+	if *memoryMax == "" && *cpuMax == 0 {
+		return "", nil
+	}
+	return "", errors.New("resource limits are only supported on Linux")
+}
+
+func joinCgroup(path string) error {
+	return errors.New("resource limits are only supported on Linux")
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+)
+
+// checkCmd checks the configuration file, .watch.toml by default, and
+// prints its problems with their lines, before starting a session:
+//
+//	watch check [file]
+func checkCmd(args []string) {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	fs.Parse(args)
+	name := configFile
+	switch fs.NArg() {
+	case 0:
+	case 1:
+		name = fs.Arg(0)
+	default:
+		log.Fatalln("usage: watch check [file]")
+	}
+	problems, err := checkConfig(name)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	for _, p := range problems {
+		fmt.Println(p)
+	}
+	if len(problems) > 0 {
+		os.Exit(1)
+	}
+	fmt.Printf("%s: ok\n", name)
+}
+
+// checkConfig applies the configuration file name to the flags as a
+// session would, and returns its problems: bad settings, patterns that
+// do not compile, commands not found, and rules that never apply.
+func checkConfig(name string) ([]string, error) {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := parseConfig(string(b))
+	if err != nil {
+		return []string{fmt.Sprintf("%s: %s", name, err)}, nil
+	}
+	var problems []string
+	problem := func(v configValue, key, format string, args ...interface{}) {
+		msg := fmt.Sprintf(format, args...)
+		if v.line == 0 {
+			problems = append(problems, fmt.Sprintf("%s: %s: %s", name, key, msg))
+			return
+		}
+		problems = append(problems, fmt.Sprintf("%s:%d: %s: %s", name, v.line, key, msg))
+	}
+	checkCommand := func(v configValue, key string, args []string) {
+		if len(args) == 0 {
+			problem(v, key, "the command is empty")
+			return
+		}
+		if _, err := exec.LookPath(args[0]); err != nil {
+			problem(v, key, "%s is not found: %s", args[0], err)
+		}
+	}
+
+	keys := make([]string, 0, len(cfg))
+	for key := range cfg {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return cfg[keys[i]].line < cfg[keys[j]].line })
+	byFlag := make(map[string]configValue)
+	for _, key := range keys {
+		v := cfg[key]
+		if key == "command" {
+			checkCommand(v, key, configCommand(v))
+			continue
+		}
+		f, err := configFlag(key)
+		if err != nil {
+			problem(v, key, "unknown setting")
+			continue
+		}
+		byFlag[f.Name] = v
+		nrules := len(rules)
+		for _, s := range v.values {
+			if err := f.Value.Set(s); err != nil {
+				problem(v, key, "bad value %q: %s", s, err)
+			}
+		}
+
+		// Compile the settings with the session's own setup.
+		switch f.Name {
+		case "x":
+			if err := setupExcludes(); err != nil {
+				problem(v, key, "%s", err)
+				excludes = nil
+			}
+		case "i", "g", "if", "e", "ext", "appear", "max-file-size", "explain-format":
+			if err := setupFilters(); err != nil {
+				problem(v, key, "%s", err)
+				// Drop the bad value, not to report it again with the next filter.
+				if l, ok := f.Value.(*stringList); ok {
+					*l = nil
+				} else {
+					f.Value.Set(f.DefValue)
+				}
+			}
+			if (f.Name == "e" || f.Name == "ext") && *extensions != "" && len(onlyExts) == 0 {
+				problem(v, key, "no extensions are given, so nothing runs")
+			}
+		case "debounce":
+			if err := setupDebounce(); err != nil {
+				problem(v, key, "%s", err)
+			}
+		case "gen":
+			checkCommand(v, key, strings.Fields(*genCmd))
+		case "migrate-cmd":
+			checkCommand(v, key, strings.Fields(*migrateCmd))
+		case "fast":
+			for _, r := range fastRules {
+				checkCommand(v, key, r.args)
+			}
+		case "rule":
+			for _, r := range rules[nrules:] {
+				checkCommand(v, key, r.args)
+			}
+		}
+	}
+
+	// A file goes to the first rule it matches, so a later rule with the
+	// same glob, or after one for every file, never applies, and neither
+	// do fast rules for the files of a rule.
+	for i, r := range rules {
+		for _, earlier := range rules[:i] {
+			if earlier.glob == r.glob || earlier.glob == "*" {
+				problem(byFlag["rule"], "rule", "%s:%s never applies: %s:%s takes its files", r.label, r.glob, earlier.label, earlier.glob)
+				break
+			}
+		}
+	}
+	for _, f := range fastRules {
+		for _, r := range rules {
+			if r.glob == f.glob || r.glob == "*" {
+				problem(byFlag["fast"], "fast", "%s never applies: rule %s:%s takes its files", f.glob, r.label, r.glob)
+				break
+			}
+		}
+	}
+	if err := checkGenFlags(); err != nil {
+		problem(byFlag["gen"], "gen", "%s", err)
+	}
+	if err := checkMigrateFlags(); err != nil {
+		problem(byFlag["migrate-cmd"], "migrate-cmd", "%s", err)
+	}
+	if _, ok := cfg["command"]; !ok && len(rules) == 0 {
+		problems = append(problems, fmt.Sprintf("%s: no command or rules: the command must be given on the command line", name))
+	}
+	return problems, nil
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"runtime"
+	"syscall"
+)
+
+// childEnv names the environment variable through which Watch passes a
+// childConfig to itself when the command needs setting up before it runs.
+const childEnv = "WATCH_CHILD_CONFIG"
+
+// A childConfig describes the setup done in the child process,
+// after it is started and before it executes the command.
+type childConfig struct {
+	// Sandbox restricts the command's file system access to ReadOnly and ReadWrite.
+	Sandbox   bool     `json:",omitempty"`
+	ReadOnly  []string `json:",omitempty"`
+	ReadWrite []string `json:",omitempty"`
+
+	// Unshare runs the command in new mount and PID namespaces, with a
+	// fresh /proc and /tmp and the project directory Dir bind-mounted.
+	// The child process stays as the namespace's init process.
+	Unshare bool   `json:",omitempty"`
+	Dir     string `json:",omitempty"`
+
+	// ReadOnlyDir runs the command in a new mount namespace
+	// in which the project directory Dir is read-only.
+	ReadOnlyDir bool `json:",omitempty"`
+
+	// NoNetwork runs the command in a new network namespace,
+	// in which only the loopback interface is available.
+	NoNetwork bool `json:",omitempty"`
+
+	// Cgroup is the path of the cgroup in which the command runs.
+	Cgroup string `json:",omitempty"`
+}
+
+// childSetup returns the setup needed by the command's child process,
+// or nil if it can execute the command directly.
+func childSetup() (*childConfig, error) {
+	var c childConfig
+	if *sandbox {
+		c.Sandbox = true
+		var err error
+		if c.ReadOnly, c.ReadWrite, err = sandboxPaths(); err != nil {
+			return nil, err
+		}
+	}
+	if *unshare {
+		if err := namespacesSupported(); err != nil {
+			return nil, err
+		}
+		c.Unshare = true
+		var err error
+		if c.Dir, err = os.Getwd(); err != nil {
+			return nil, err
+		}
+	}
+	if *readOnlyDir {
+		if err := namespacesSupported(); err != nil {
+			return nil, err
+		}
+		c.ReadOnlyDir = true
+		var err error
+		if c.Dir, err = os.Getwd(); err != nil {
+			return nil, err
+		}
+	}
+	if *noNetwork {
+		if err := namespacesSupported(); err != nil {
+			return nil, err
+		}
+		c.NoNetwork = true
+	}
+	var err error
+	if c.Cgroup, err = newCgroup(); err != nil {
+		return nil, err
+	}
+	if !c.Sandbox && !c.Unshare && !c.ReadOnlyDir && !c.NoNetwork && c.Cgroup == "" {
+		return nil, nil
+	}
+	return &c, nil
+}
+
+// command returns the exec.Cmd running args, re-executing
+// Watch to set up the child process first if needed.
+func command(c *childConfig, args []string) (*exec.Cmd, error) {
+	if err := checkAllowed(args[0]); err != nil {
+		return nil, err
+	}
+	if c == nil {
+		return exec.Command(args[0], args[1:]...), nil
+	}
+	self, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	b, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.Command(self, args...)
+	cmd.Env = append(os.Environ(), childEnv+"="+string(b))
+	cmd.SysProcAttr = namespaceAttr(c)
+	return cmd, nil
+}
+
+// childMain sets up the child process described by the JSON childConfig
+// cfg and executes the command named by the arguments in its place.
+// It never returns.
+func childMain(cfg string) {
+	fail := func(f string, vals ...interface{}) {
+		fmt.Fprintf(os.Stderr, "Watch: "+f+"\n", vals...)
+		os.Exit(126)
+	}
+	var c childConfig
+	if err := json.Unmarshal([]byte(cfg), &c); err != nil {
+		fail("bad child configuration: %s", err)
+	}
+	os.Unsetenv(childEnv)
+	if len(os.Args) < 2 {
+		fail("no command")
+	}
+	path, err := exec.LookPath(os.Args[1])
+	if err != nil {
+		fail("%s", err)
+	}
+	if c.Cgroup != "" {
+		if err := joinCgroup(c.Cgroup); err != nil {
+			fail("failed to join cgroup: %s", err)
+		}
+	}
+	// Process attributes such as Landlock domains belong to the thread
+	// that sets them, so the same thread must start the command.
+	runtime.LockOSThread()
+	if c.NoNetwork {
+		if err := loopbackUp(); err != nil {
+			fail("failed to set up loopback interface: %s", err)
+		}
+	}
+	if c.Unshare || c.ReadOnlyDir {
+		if err := setupMounts(&c); err != nil {
+			fail("failed to set up mounts: %s", err)
+		}
+	}
+	if err := clearAmbientCaps(); err != nil {
+		fail("failed to drop capabilities: %s", err)
+	}
+	if c.Sandbox {
+		if err := restrictFS(c.ReadOnly, c.ReadWrite); err != nil {
+			fail("failed to sandbox command: %s", err)
+		}
+	}
+	if c.Unshare {
+		os.Exit(runInit(path, os.Args[1:]))
+	}
+	err = syscall.Exec(path, os.Args[1:], os.Environ())
+	fail("%s", err)
+}
+
+// runInit runs the command as the child of an init process, forwarding
+// signals to it and reaping orphans, and returns its exit status.
+func runInit(path string, args []string) int {
+	sigs := make(chan os.Signal, 16)
+	signal.Notify(sigs, syscall.SIGCHLD, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP, syscall.SIGQUIT)
+
+	cmd := &exec.Cmd{Path: path, Args: args, Stdin: os.Stdin, Stdout: os.Stdout, Stderr: os.Stderr}
+	if err := cmd.Start(); err != nil {
+		fmt.Fprintf(os.Stderr, "Watch: %s\n", err)
+		return 126
+	}
+	pid := cmd.Process.Pid
+	for s := range sigs {
+		if s != syscall.SIGCHLD {
+			syscall.Kill(pid, s.(syscall.Signal))
+			continue
+		}
+		// Reap every exited child, including orphans reparented to init.
+		for {
+			var status syscall.WaitStatus
+			p, err := syscall.Wait4(-1, &status, syscall.WNOHANG, nil)
+			if err != nil || p <= 0 {
+				break
+			}
+			if p == pid {
+				if status.Signaled() {
+					return 128 + int(status.Signal())
+				}
+				return status.ExitStatus()
+			}
+		}
+	}
+	return 0
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+var (
+	genCmd    = flag.String("gen", "", "A code generator to run before the command when files matching -gen-inputs change, e.g. \"buf generate\"")
+	genInputs = flag.String("gen-inputs", "", "A glob matching the inputs of -gen, e.g. *.proto")
+)
+
+// needsGen reports whether the generator must run before the command.
+func needsGen(reason string, changes []change) bool {
+	if *genCmd == "" {
+		return false
+	}
+	if reason == "start" {
+		return true
+	}
+	for _, c := range changes {
+		if matchGlob(*genInputs, c.path) {
+			return true
+		}
+	}
+	return false
+}
+
+// runGen runs the generator, reporting whether it succeeded.
+// It is killed if ctx is canceled.
+func runGen(ctx context.Context, out io.Writer) bool {
+	args := strings.Fields(*genCmd)
+	io.WriteString(out, "gen: "+*genCmd+"\n")
+	if err := checkAllowed(args[0]); err != nil {
+		io.WriteString(out, "fatal: "+err.Error()+"\n")
+		return false
+	}
+	if err := runStep(ctx, out, "gen", args); err != nil {
+		io.WriteString(out, "gen: "+err.Error()+"\n")
+		return false
+	}
+	return true
+}
+
+// collectGenerated gathers the changes a generator made, waiting until
+// none have come for -d. They become inputs of the command's run rather
+// than triggering another. The other changes, to the generator's own
+// inputs, those isInput reports, or to the files of a -rule, are
+// returned separately, to be handled as usual.
+func collectGenerated(changes <-chan change, isInput func(p string) bool) (generated, others []change) {
+	quiet := time.NewTimer(defaultDelay())
+	defer quiet.Stop()
+	for {
+		select {
+		case c := <-changes:
+			if isInput(c.path) || ruleFor(c.path) != nil {
+				others = append(others, c)
+			} else {
+				generated = append(generated, c)
+			}
+			quiet.Reset(defaultDelay())
+		case <-quiet.C:
+			return generated, others
+		}
+	}
+}
+
+// isGenInput reports whether p is an input of -gen.
+func isGenInput(p string) bool {
+	return matchGlob(*genInputs, p)
+}
+
+// checkGenFlags checks that -gen and -gen-inputs are given together.
+func checkGenFlags() error {
+	if (*genCmd == "") != (*genInputs == "") {
+		return fmt.Errorf("-gen and -gen-inputs must be given together")
+	}
+	if *genCmd != "" && len(strings.Fields(*genCmd)) == 0 {
+		return fmt.Errorf("-gen is empty")
+	}
+	return nil
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// configFile is the name of the project's configuration file, in the
+// working directory. It holds flags, by name, and the command:
+//
+//	# .watch.toml
+//	paths = ["cmd", "internal"]
+//	exclude = ['_test\.go$']
+//	debounce = "500ms"
+//	command = ["go", "test", "./..."]
+//
+// Flags given on the command line override those in the file.
+const configFile = ".watch.toml"
+
+// configAliases are the names in the configuration file of flags whose
+// own names are terse.
+var configAliases = map[string]string{
+	"paths":    "p",
+	"exclude":  "x",
+	"debounce": "d",
+}
+
+// A configValue is a value in the configuration file: a string, number,
+// or boolean, kept as written, or an array of them.
+type configValue struct {
+	values []string
+	array  bool
+	line   int // where its key is
+}
+
+// reloadable are the flags that reloading the configuration file applies
+// to the running session. The others take a restart.
+var reloadable = map[string]bool{"x": true, "g": true, "d": true, "debounce": true, "rule": true}
+
+// loadedConfig is the configuration file as last loaded.
+var loadedConfig map[string]configValue
+
+// readConfig reads and parses the configuration file, if there is one.
+func readConfig() (map[string]configValue, error) {
+	cfg, err := readConfigFile(configFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return cfg, err
+}
+
+// readConfigFile reads and parses the configuration file name.
+func readConfigFile(name string) (map[string]configValue, error) {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := parseConfig(string(b))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", name, err)
+	}
+	return cfg, nil
+}
+
+// configFlag returns the flag set by the key.
+func configFlag(key string) (*flag.Flag, error) {
+	name := key
+	if a, ok := configAliases[key]; ok {
+		name = a
+	}
+	f := flag.Lookup(name)
+	if f == nil {
+		return nil, fmt.Errorf("%s: unknown setting %s", configFile, key)
+	}
+	return f, nil
+}
+
+// givenFlags returns the names of the flags given on the command line.
+func givenFlags() map[string]bool {
+	given := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	return given
+}
+
+// configCommand returns the command a configuration value gives: an
+// array, or a string split into fields.
+func configCommand(v configValue) []string {
+	if !v.array && len(v.values) == 1 {
+		return strings.Fields(v.values[0])
+	}
+	return v.values
+}
+
+// loadConfig applies the configuration file, if there is one, to the
+// flags not given on the command line, and returns the command it gives.
+func loadConfig() ([]string, error) {
+	cfg, err := readConfig()
+	if err != nil {
+		return nil, err
+	}
+	given := givenFlags()
+	var command []string
+	for key, v := range cfg {
+		if key == "command" {
+			command = configCommand(v)
+			continue
+		}
+		f, err := configFlag(key)
+		if err != nil {
+			return nil, err
+		}
+		if given[f.Name] {
+			continue
+		}
+		for _, s := range v.values {
+			if err := f.Value.Set(s); err != nil {
+				return nil, fmt.Errorf("%s: bad %s: %s", configFile, key, err)
+			}
+		}
+	}
+	loadedConfig = cfg
+	return command, nil
+}
+
+// reloadConfig applies the changes to the configuration file since it
+// was last loaded to the reloadable flags not given on the command line,
+// and compiles them again. It returns the names of the flags changed.
+// Other changes are logged as taking a restart.
+func reloadConfig() (map[string]bool, error) {
+	cfg, err := readConfig()
+	if err != nil {
+		return nil, err
+	}
+	keys := make(map[string]bool)
+	for key := range loadedConfig {
+		keys[key] = true
+	}
+	for key := range cfg {
+		keys[key] = true
+	}
+	given := givenFlags()
+	changed := make(map[string]bool)
+	for key := range keys {
+		old, v := loadedConfig[key], cfg[key]
+		if old.array == v.array && reflect.DeepEqual(old.values, v.values) {
+			continue
+		}
+		if key == "command" {
+			if flag.NArg() == 0 {
+				log.Printf("Restart to run the new command from %s", configFile)
+			}
+			continue
+		}
+		f, err := configFlag(key)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case given[f.Name]:
+		case !reloadable[f.Name]:
+			log.Printf("Restart to apply the new %s from %s", key, configFile)
+		default:
+			changed[f.Name] = true
+		}
+	}
+
+	// -d is read by the rules as it changes.
+	filtersMu.Lock()
+	for name := range changed {
+		f := flag.Lookup(name)
+		switch v := f.Value.(type) {
+		case *stringList:
+			*v = nil
+		case *ruleList:
+			*v = nil
+		default:
+			f.Value.Set(f.DefValue)
+		}
+	}
+	for key, v := range cfg {
+		f, err := configFlag(key)
+		if err != nil || !changed[f.Name] {
+			continue
+		}
+		for _, s := range v.values {
+			if err := f.Value.Set(s); err != nil {
+				filtersMu.Unlock()
+				return nil, fmt.Errorf("%s: bad %s: %s", configFile, key, err)
+			}
+		}
+	}
+	filtersMu.Unlock()
+	loadedConfig = cfg
+
+	if changed["x"] {
+		if err := setupExcludes(); err != nil {
+			return nil, err
+		}
+	}
+	if changed["g"] {
+		if err := setupGlobs(); err != nil {
+			return nil, err
+		}
+	}
+	if changed["debounce"] {
+		if err := setupDebounce(); err != nil {
+			return nil, err
+		}
+	}
+	var names []string
+	for name := range changed {
+		names = append(names, "-"+name)
+	}
+	sort.Strings(names)
+	if len(names) > 0 {
+		log.Printf("Reloaded %s from %s", strings.Join(names, ", "), configFile)
+	} else {
+		log.Printf("Nothing to reload in %s", configFile)
+	}
+	return changed, nil
+}
+
+// parseConfig parses the subset of TOML used by the configuration file:
+// keys set to strings, numbers, booleans, or arrays of them, with comments.
+func parseConfig(s string) (map[string]configValue, error) {
+	cfg := make(map[string]configValue)
+	lines := strings.Split(s, "\n")
+	for n := 0; n < len(lines); n++ {
+		line := strings.TrimSpace(lines[n])
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		if line[0] == '[' {
+			return nil, fmt.Errorf("line %d: tables are not supported", n+1)
+		}
+		i := strings.IndexByte(line, '=')
+		if i < 0 {
+			return nil, fmt.Errorf("line %d: expected key = value", n+1)
+		}
+		key := strings.Trim(strings.TrimSpace(line[:i]), `"`)
+		rest := strings.TrimSpace(line[i+1:])
+		// An array may go on over several lines.
+		start := n + 1
+		for strings.HasPrefix(rest, "[") && !arrayClosed(rest) && n+1 < len(lines) {
+			n++
+			rest += "\n" + lines[n]
+		}
+		v, err := parseConfigValue(rest)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s: %s", start, key, err)
+		}
+		v.line = start
+		if _, ok := cfg[key]; ok {
+			return nil, fmt.Errorf("line %d: %s is set twice", start, key)
+		}
+		cfg[key] = v
+	}
+	return cfg, nil
+}
+
+// arrayClosed reports whether s holds the closing bracket of the array
+// it starts, outside strings and comments.
+func arrayClosed(s string) bool {
+	for len(s) > 0 {
+		switch s[0] {
+		case ']':
+			return true
+		case '"', '\'':
+			_, rest, err := configString(s)
+			if err != nil {
+				return false
+			}
+			s = rest
+			continue
+		case '#':
+			i := strings.IndexByte(s, '\n')
+			if i < 0 {
+				return false
+			}
+			s = s[i:]
+		}
+		s = s[1:]
+	}
+	return false
+}
+
+// parseConfigValue parses the value of a key, up to a trailing comment.
+func parseConfigValue(s string) (configValue, error) {
+	if !strings.HasPrefix(s, "[") {
+		v, rest, err := configScalar(s)
+		if err != nil {
+			return configValue{}, err
+		}
+		if err := configEnd(rest); err != nil {
+			return configValue{}, err
+		}
+		return configValue{values: []string{v}}, nil
+	}
+	cv := configValue{array: true}
+	s = s[1:]
+	for {
+		s = skipConfigSpace(s)
+		if strings.HasPrefix(s, "]") {
+			return cv, configEnd(s[1:])
+		}
+		v, rest, err := configScalar(s)
+		if err != nil {
+			return configValue{}, err
+		}
+		cv.values = append(cv.values, v)
+		s = skipConfigSpace(rest)
+		switch {
+		case strings.HasPrefix(s, ","):
+			s = s[1:]
+		case strings.HasPrefix(s, "]"):
+		default:
+			return configValue{}, fmt.Errorf("expected , or ] in array")
+		}
+	}
+}
+
+// skipConfigSpace skips white space, new lines, and comments.
+func skipConfigSpace(s string) string {
+	for {
+		s = strings.TrimLeft(s, " \t\r\n")
+		if !strings.HasPrefix(s, "#") {
+			return s
+		}
+		i := strings.IndexByte(s, '\n')
+		if i < 0 {
+			return ""
+		}
+		s = s[i:]
+	}
+}
+
+// configEnd checks that only a comment follows a value.
+func configEnd(s string) error {
+	if s = strings.TrimSpace(s); s != "" && s[0] != '#' {
+		return fmt.Errorf("unexpected %q after the value", s)
+	}
+	return nil
+}
+
+// configScalar parses a string, number, or boolean at the start of s,
+// returning it and the rest of s.
+func configScalar(s string) (string, string, error) {
+	if strings.HasPrefix(s, `"`) || strings.HasPrefix(s, "'") {
+		return configString(s)
+	}
+	i := strings.IndexAny(s, " \t\r\n,]#")
+	if i < 0 {
+		i = len(s)
+	}
+	v := s[:i]
+	if v == "true" || v == "false" {
+		return v, s[i:], nil
+	}
+	if _, err := strconv.ParseFloat(strings.Replace(v, "_", "", -1), 64); err != nil {
+		return "", "", fmt.Errorf("bad value %q", v)
+	}
+	return strings.Replace(v, "_", "", -1), s[i:], nil
+}
+
+// configString parses a basic "string", with escapes, or a literal
+// 'string', without, at the start of s.
+func configString(s string) (string, string, error) {
+	q := s[0]
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == q:
+			return b.String(), s[i+1:], nil
+		case c == '\n':
+			return "", "", fmt.Errorf("unterminated string")
+		case c == '\\' && q == '"' && i+1 < len(s):
+			i++
+			switch s[i] {
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			case '"', '\\':
+				b.WriteByte(s[i])
+			default:
+				return "", "", fmt.Errorf("unknown escape \\%c", s[i])
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", "", fmt.Errorf("unterminated string")
+}
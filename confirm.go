@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"sync"
+)
+
+var confirmRuns = flag.Bool("confirm", false, "Show the changed files and wait for a keypress on the terminal before each run")
+
+// confirmMu keeps to one prompt at a time, since rules ask too.
+var confirmMu sync.Mutex
+
+// A confirmation is the answer to the prompt for a run of the command,
+// sent back to the loop that asked, which goes on meanwhile.
+type confirmation struct {
+	reason, line string
+	changes      []change // those shown
+	ok           bool
+}
+
+// confirmRule asks, as confirm does, whether to run a rule's command,
+// declining if ctx is canceled first.
+func confirmRule(ctx context.Context, label string, changes []change) bool {
+	c := make(chan bool, 1)
+	go func() { c <- confirm("-rule "+label, changes) }()
+	select {
+	case ok := <-c:
+		return ok
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// confirm shows the changed files on the terminal and asks whether to
+// run the command, or what names, returning whether to run it.
+func confirm(what string, changes []change) bool {
+	confirmMu.Lock()
+	defer confirmMu.Unlock()
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		log.Printf("Failed to open the terminal to confirm the run: %s", err)
+		return false
+	}
+	defer tty.Close()
+
+	files := runResult{changes: changes}.files()
+	if len(files) == 0 {
+		fmt.Fprintln(tty, "No files changed.")
+	} else {
+		fmt.Fprintln(tty, "Changed:")
+		for _, f := range files {
+			fmt.Fprintln(tty, "\t"+f)
+		}
+	}
+	if what == "" {
+		fmt.Fprint(tty, "Run? [Y/n] ")
+	} else {
+		fmt.Fprintf(tty, "Run %s? [Y/n] ", what)
+	}
+
+	// Read a single key, without waiting for a newline.
+	if err := stty(tty, "-icanon", "min", "1"); err != nil {
+		debugPrint("stty failed: %s", err)
+	} else {
+		defer stty(tty, "icanon")
+	}
+	var b [1]byte
+	if _, err := tty.Read(b[:]); err != nil {
+		log.Printf("Failed to read from the terminal: %s", err)
+		return false
+	}
+	if b[0] != '\n' {
+		fmt.Fprintln(tty)
+	}
+	switch b[0] {
+	case 'y', 'Y', '\n', '\r', ' ':
+		return true
+	default:
+		fmt.Fprintln(tty, "Skipped.")
+		return false
+	}
+}
+
+func stty(tty *os.File, args ...string) error {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = tty
+	return cmd.Run()
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ctlVersion is the version of the control protocol. It is only
+// incremented for incompatible changes; clients must ignore
+// message types and fields that they do not know.
+const ctlVersion = 1
+
+var ctlPath = flag.String("ctl", "", "Listen for control connections on this Unix socket (default: one per directory in the state directory)")
+
+// triggers receives a value whenever a run is requested
+// through the control socket or triggerSignal.
+var triggers = make(chan struct{}, 1)
+
+// notifyTrigger requests a run on triggerSignal, where there is one.
+func notifyTrigger() {
+	if triggerSignal == nil {
+		return
+	}
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, triggerSignal)
+	go func() {
+		for range sigs {
+			select {
+			case triggers <- struct{}{}:
+			default:
+			}
+		}
+	}()
+}
+
+// defaultCtlPath returns the control socket of the session running in dir.
+// The name is a hash of the directory, since socket paths are short.
+func defaultCtlPath(dir string) string {
+	h := sha256.Sum256([]byte(dir))
+	return filepath.Join(stateDir(), "sockets", fmt.Sprintf("%x.sock", h[:8]))
+}
+
+// A ctlRequest is a line sent by a control client.
+type ctlRequest struct {
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method"`
+	Version int             `json:"version,omitempty"`
+	// Path is the directory of add-path and remove-path requests, and
+	// the file of simulate requests.
+	Path string `json:"path,omitempty"`
+	// Op is the event of simulate requests: create, write, remove,
+	// rename, or chmod.
+	Op string `json:"op,omitempty"`
+}
+
+// A ctlMessage is a line sent to a control client: a reply to a
+// request, or, for subscribed clients, an event about a run.
+type ctlMessage struct {
+	Type    string          `json:"type"` // hello, reply, run-started, or run-finished
+	ID      json.RawMessage `json:"id,omitempty"`
+	Error   string          `json:"error,omitempty"`
+	Version int             `json:"version,omitempty"`
+	Dir     string          `json:"dir,omitempty"`
+	Status  *runStatus      `json:"status,omitempty"`
+	Queue   *queueState     `json:"queue,omitempty"`
+	Run     *ctlRun         `json:"run,omitempty"`
+	// Decisions are those made about the event of a simulate request.
+	Decisions []explanation `json:"decisions,omitempty"`
+}
+
+// A ctlRun describes a run in run-started and run-finished events.
+type ctlRun struct {
+	Command     []string        `json:"command"`
+	Start       time.Time       `json:"start"`
+	End         *time.Time      `json:"end,omitempty"`
+	ExitStatus  *int            `json:"exit_status,omitempty"`
+	Files       []string        `json:"files,omitempty"`
+	Diagnostics []ctlDiagnostic `json:"diagnostics,omitempty"`
+}
+
+type ctlDiagnostic struct {
+	File     string `json:"file"`
+	Line     int    `json:"line"`
+	Col      int    `json:"col,omitempty"`
+	Severity string `json:"severity"` // error or warning
+	Message  string `json:"message"`
+}
+
+// A ctlServer serves the line-delimited JSON control protocol
+// on a Unix socket and sends run events to subscribed clients.
+type ctlServer struct {
+	dir string
+
+	mu     sync.Mutex
+	status runStatus
+	subs   map[*ctlConn]bool
+}
+
+type ctlConn struct {
+	net.Conn
+	out chan ctlMessage
+}
+
+func newCtlServer() (reporter, error) {
+	dir, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+	p := *ctlPath
+	if p == "" {
+		p = defaultCtlPath(dir)
+		if !filepath.IsAbs(p) {
+			log.Printf("Not listening for control connections: the state directory %s is relative; set $HOME or $XDG_STATE_HOME", stateDir())
+			return nil, nil
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return nil, fmt.Errorf("Failed to create control socket directory: %s", err)
+	}
+	if c, err := net.Dial("unix", p); err == nil {
+		c.Close()
+		log.Printf("Another Watch is listening on %s; not listening for control connections", p)
+		return nil, nil
+	}
+	os.Remove(p)
+	l, err := net.Listen("unix", p)
+	if err != nil {
+		log.Printf("Failed to listen for control connections: %s", err)
+		return nil, nil
+	}
+	atExit(func() { os.Remove(p) })
+	debugPrint("Listening for control connections on %s", p)
+
+	s := &ctlServer{dir: dir, subs: make(map[*ctlConn]bool)}
+	go s.serve(l)
+	return s, nil
+}
+
+func (s *ctlServer) serve(l net.Listener) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			log.Printf("Control socket failed: %s", err)
+			return
+		}
+		cc := &ctlConn{Conn: c, out: make(chan ctlMessage, 64)}
+		go cc.write()
+		go s.handle(cc)
+	}
+}
+
+// write sends messages to the client until its connection is closed.
+func (c *ctlConn) write() {
+	enc := json.NewEncoder(c)
+	for m := range c.out {
+		if err := enc.Encode(m); err != nil {
+			c.Close()
+			for range c.out {
+			}
+			return
+		}
+	}
+	c.Close()
+}
+
+func (s *ctlServer) handle(c *ctlConn) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.subs, c)
+		s.mu.Unlock()
+		close(c.out)
+	}()
+
+	c.out <- ctlMessage{Type: "hello", Version: ctlVersion, Dir: s.dir}
+
+	sc := bufio.NewScanner(c)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" {
+			continue
+		}
+		var req ctlRequest
+		if err := json.Unmarshal([]byte(line), &req); err != nil {
+			c.out <- ctlMessage{Type: "reply", Error: "bad request: " + err.Error()}
+			continue
+		}
+		reply := ctlMessage{Type: "reply", ID: req.ID}
+		switch req.Method {
+		case "hello":
+			if req.Version > ctlVersion {
+				reply.Error = fmt.Sprintf("unsupported protocol version %d", req.Version)
+			}
+			reply.Version = ctlVersion
+
+		case "subscribe":
+			s.mu.Lock()
+			s.subs[c] = true
+			s.mu.Unlock()
+
+		case "status":
+			s.mu.Lock()
+			st := s.status
+			s.mu.Unlock()
+			q := currentQueue()
+			reply.Status, reply.Queue = &st, &q
+
+		case "trigger":
+			select {
+			case triggers <- struct{}{}:
+			default:
+			}
+
+		case "add-path":
+			if err := changeWatch("add", req.Path); err != nil {
+				reply.Error = err.Error()
+			}
+
+		case "remove-path":
+			if err := changeWatch("remove", req.Path); err != nil {
+				reply.Error = err.Error()
+			}
+
+		case "pause", "resume":
+			pauses <- req.Method
+
+		case "simulate":
+			op := req.Op
+			if op == "" {
+				op = "write"
+			}
+			d, err := simulate(req.Path, op)
+			if err != nil {
+				reply.Error = err.Error()
+			}
+			reply.Decisions = d
+
+		case "upgrade":
+			select {
+			case upgrades <- struct{}{}:
+			default:
+			}
+
+		default:
+			reply.Error = "unknown method: " + req.Method
+		}
+		c.out <- reply
+	}
+}
+
+// broadcast sends m to every subscribed client,
+// disconnecting those too slow to keep up.
+func (s *ctlServer) broadcast(m ctlMessage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.subs {
+		select {
+		case c.out <- m:
+		default:
+			debugPrint("disconnecting slow control client")
+			delete(s.subs, c)
+			c.Close()
+		}
+	}
+}
+
+func (s *ctlServer) started(r runResult) {
+	s.mu.Lock()
+	s.status = runStatus{Command: strings.Join(r.args, " "), State: "running", Time: r.start}
+	s.mu.Unlock()
+	s.broadcast(ctlMessage{Type: "run-started", Run: &ctlRun{Command: r.args, Start: r.start}})
+}
+
+func (s *ctlServer) finished(r runResult) {
+	s.mu.Lock()
+	s.status = newRunStatus(r)
+	s.mu.Unlock()
+
+	run := &ctlRun{Command: r.args, Start: r.start, End: &r.end, ExitStatus: &r.status, Files: r.files()}
+	for _, d := range r.diags {
+		sev := "error"
+		if d.warning() {
+			sev = "warning"
+		}
+		run.Diagnostics = append(run.Diagnostics, ctlDiagnostic{
+			File:     absPath(d.File),
+			Line:     d.Line,
+			Col:      d.Col,
+			Severity: sev,
+			Message:  d.Message,
+		})
+	}
+	s.broadcast(ctlMessage{Type: "run-finished", Run: run})
+}
+
+// findCtlSocket returns the control socket of the session running in
+// dir or the nearest of its parents.
+func findCtlSocket(dir string) (string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	for {
+		p := defaultCtlPath(dir)
+		if _, err := os.Stat(p); err == nil {
+			return p, nil
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", fmt.Errorf("no Watch is running in %s", dir)
+		}
+		dir = parent
+	}
+}
+
+// ctlCmd sends a request to the running session for the working directory:
+//
+//	watch ctl status
+//	watch ctl trigger
+//	watch ctl pause
+//	watch ctl resume
+//	watch ctl add-path <dir>
+//	watch ctl remove-path <dir>
+func ctlCmd(args []string) {
+	fs := flag.NewFlagSet("ctl", flag.ExitOnError)
+	sock := fs.String("socket", "", "The control socket (default: that of the session for the working directory)")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s ctl [-socket path] status|trigger|pause|resume|add-path <dir>|remove-path <dir>\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	req := ctlRequest{Method: fs.Arg(0), Version: ctlVersion}
+	switch req.Method {
+	case "status", "trigger", "pause", "resume":
+	case "add-path", "remove-path":
+		if fs.NArg() != 2 {
+			fs.Usage()
+			os.Exit(2)
+		}
+		p, err := filepath.Abs(fs.Arg(1))
+		if err != nil {
+			log.Fatalln(err)
+		}
+		req.Path = p
+	default:
+		log.Fatalf("Unknown control method %q", req.Method)
+	}
+
+	m, err := sendCtl(*sock, req)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if m.Status != nil && m.Status.State != "" {
+		fmt.Printf("last: %s\n", m.Status.text())
+	}
+	if m.Queue != nil {
+		fmt.Print(m.Queue.text())
+	}
+}
+
+// sendCtl sends a request to the control socket, by default that of the
+// session for the working directory, and returns the reply.
+func sendCtl(sock string, req ctlRequest) (ctlMessage, error) {
+	if sock == "" {
+		var err error
+		if sock, err = findCtlSocket("."); err != nil {
+			return ctlMessage{}, err
+		}
+	}
+	c, err := net.Dial("unix", sock)
+	if err != nil {
+		return ctlMessage{}, fmt.Errorf("Failed to connect to %s: %s", sock, err)
+	}
+	defer c.Close()
+	if err := json.NewEncoder(c).Encode(req); err != nil {
+		return ctlMessage{}, err
+	}
+	dec := json.NewDecoder(c)
+	for {
+		var m ctlMessage
+		if err := dec.Decode(&m); err != nil {
+			return ctlMessage{}, fmt.Errorf("Failed to read reply: %s", err)
+		}
+		if m.Type != "reply" {
+			continue
+		}
+		if m.Error != "" {
+			return m, errors.New(m.Error)
+		}
+		return m, nil
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var debounceFlags stringList
+
+func init() {
+	flag.Var(&debounceFlags, "debounce", "Wait this long after changes to files matching a glob, as glob=duration, e.g. *.proto=2s (may be repeated)")
+}
+
+// A debounceRule is a parsed -debounce flag.
+type debounceRule struct {
+	pattern string
+	delay   time.Duration
+}
+
+var debounceRules []debounceRule
+
+// setupDebounce parses the -debounce flags.
+func setupDebounce() error {
+	debounceRules = nil
+	for _, f := range debounceFlags {
+		i := strings.LastIndex(f, "=")
+		if i < 0 {
+			return fmt.Errorf("invalid -debounce %q: want glob=duration", f)
+		}
+		pat := f[:i]
+		if _, err := filepath.Match(pat, ""); err != nil {
+			return fmt.Errorf("invalid -debounce pattern %q: %s", pat, err)
+		}
+		d, err := time.ParseDuration(f[i+1:])
+		if err != nil {
+			return fmt.Errorf("invalid -debounce %q: %s", f, err)
+		}
+		debounceRules = append(debounceRules, debounceRule{pat, d})
+	}
+	return nil
+}
+
+// debounceDelay returns how long to wait for more changes after the
+// pending ones: the longest delay of any of them, so that a slow
+// generator is waited for even if quicker files change after it.
+func debounceDelay(pending []change) time.Duration {
+	max := time.Duration(0)
+	for _, c := range pending {
+		d := defaultDelay()
+		for _, r := range debounceRules {
+			if matchGlob(r.pattern, c.path) {
+				d = r.delay
+				break
+			}
+		}
+		if d > max {
+			max = d
+		}
+	}
+	return max
+}
+
+// matchGlob reports whether the path matches the glob, which matches
+// just the base name if it has no slash and the whole path otherwise.
+func matchGlob(pattern, path string) bool {
+	if !strings.Contains(pattern, "/") {
+		path = filepath.Base(path)
+	}
+	ok, _ := filepath.Match(pattern, filepath.ToSlash(path))
+	return ok
+}
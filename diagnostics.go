@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// errorLineRe matches output lines that look like an error report.
+var errorLineRe = regexp.MustCompile(`(?i)\b(error|fail(ed|ure)?|panic)\b|^\S+:\d+(:\d+)?: `)
+
+// diagnosticRe matches compiler-style file:line[:col]: message lines.
+var diagnosticRe = regexp.MustCompile(`^\s*([^\s:]+):(\d+)(?::(\d+))?:\s*(.*)$`)
+
+// maxDiagnostics limits the diagnostics collected from a single run.
+const maxDiagnostics = 1000
+
+// A diagnostic is an error or warning reported at a
+// position in a file by a line of the command's output.
+type diagnostic struct {
+	File    string
+	Line    int
+	Col     int // 0 if the line has no column.
+	Message string
+}
+
+// warning returns whether d looks like a warning rather than an error.
+func (d diagnostic) warning() bool {
+	return strings.HasPrefix(strings.ToLower(d.Message), "warning")
+}
+
+func parseDiagnostic(line string) (diagnostic, bool) {
+	m := diagnosticRe.FindStringSubmatch(line)
+	if m == nil {
+		return diagnostic{}, false
+	}
+	d := diagnostic{File: m[1], Message: m[4]}
+	d.Line, _ = strconv.Atoi(m[2])
+	if m[3] != "" {
+		d.Col, _ = strconv.Atoi(m[3])
+	}
+	return d, d.Line > 0
+}
+
+// An outputScanner is an io.Writer that records the first line written
+// to it that looks like an error, and the diagnostics in its lines.
+type outputScanner struct {
+	first string
+	diags []diagnostic
+	line  []byte
+}
+
+func (s *outputScanner) Write(p []byte) (int, error) {
+	s.line = append(s.line, p...)
+	for {
+		i := bytes.IndexByte(s.line, '\n')
+		if i < 0 {
+			break
+		}
+		s.scan(string(s.line[:i]))
+		s.line = s.line[i+1:]
+	}
+	return len(p), nil
+}
+
+// Close scans any final unterminated line.
+func (s *outputScanner) Close() error {
+	if len(s.line) > 0 {
+		s.scan(string(s.line))
+		s.line = nil
+	}
+	return nil
+}
+
+func (s *outputScanner) scan(l string) {
+	l = strings.TrimRight(l, "\r")
+	if s.first == "" && errorLineRe.MatchString(strings.TrimSpace(l)) {
+		s.first = strings.TrimSpace(l)
+	}
+	if d, ok := parseDiagnostic(l); ok && len(s.diags) < maxDiagnostics {
+		s.diags = append(s.diags, d)
+	}
+}
+
+// absPath returns p made absolute relative to the working directory,
+// or p itself if that fails.
+func absPath(p string) string {
+	if a, err := filepath.Abs(p); err == nil {
+		return a
+	}
+	return p
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// diffContext is the number of unchanged lines shown around changes.
+const diffContext = 2
+
+// diffCmd compares two runs in the history, the last two by default:
+//
+//	watch diff [-l] [run-a run-b]
+func diffCmd(args []string) {
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	list := fs.Bool("l", false, "List the runs in the history instead")
+	fs.Parse(args)
+
+	wd, err := os.Getwd()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	dir := historyDir(wd)
+	ns := historyRuns(dir)
+	if len(ns) == 0 {
+		log.Fatalln("No runs in the history: run Watch with -history")
+	}
+	if *list {
+		for _, n := range ns {
+			hr, err := loadHistoryRun(dir, n)
+			if err != nil {
+				log.Fatalln(err)
+			}
+			fmt.Printf("%d\t%s\n", n, hr.describe())
+		}
+		return
+	}
+
+	last := ns[len(ns)-1]
+	runs := []int{last - 1, last}
+	switch fs.NArg() {
+	case 0:
+	case 2:
+		for i, a := range fs.Args() {
+			n, err := strconv.Atoi(a)
+			if err != nil {
+				log.Fatalf("Bad run number %q", a)
+			}
+			runs[i] = n
+		}
+	default:
+		log.Fatalln("usage: watch diff [-l] [run-a run-b]")
+	}
+	a, err := loadHistoryRun(dir, runs[0])
+	if err != nil {
+		log.Fatalln(err)
+	}
+	b, err := loadHistoryRun(dir, runs[1])
+	if err != nil {
+		log.Fatalln(err)
+	}
+	printRunDiff(os.Stdout, a, b)
+}
+
+// describe sums up the run in a line.
+func (hr historyRun) describe() string {
+	return fmt.Sprintf("%s %s run, exit status %d in %s: %s", hr.Start.Format("2006-01-02 15:04:05"), hr.Reason,
+		hr.Status, hr.End.Sub(hr.Start).Round(time.Millisecond), strings.Join(hr.Args, " "))
+}
+
+// printRunDiff prints how run b differs from run a: its command, its
+// changed files, its toolchain and environment, and its output.
+func printRunDiff(out io.Writer, a, b historyRun) {
+	fmt.Fprintf(out, "run %d: %s\n", a.N, a.describe())
+	fmt.Fprintf(out, "run %d: %s\n", b.N, b.describe())
+	if x, y := strings.Join(a.Args, " "), strings.Join(b.Args, " "); x != y {
+		fmt.Fprintf(out, "command:\n-%s\n+%s\n", x, y)
+	}
+
+	if files := setDiff(a.Files, b.Files); len(files) > 0 {
+		fmt.Fprintf(out, "changed files:\n%s\n", strings.Join(files, "\n"))
+	}
+	if capture := setDiff(a.Capture.lines(), b.Capture.lines()); len(capture) > 0 {
+		fmt.Fprintf(out, "toolchain and environment:\n%s\n", strings.Join(capture, "\n"))
+	}
+
+	for _, o := range []struct{ name, a, b string }{{"stdout", a.Stdout, b.Stdout}, {"stderr", a.Stderr, b.Stderr}} {
+		if o.a == o.b {
+			continue
+		}
+		fmt.Fprintf(out, "--- %s of run %d\n+++ %s of run %d\n", o.name, a.N, o.name, b.N)
+		printLineDiff(out, splitLines(o.a), splitLines(o.b))
+	}
+}
+
+// setDiff returns the lines only in a, prefixed with -, and then those
+// only in b, prefixed with +.
+func setDiff(a, b []string) []string {
+	in := make(map[string]bool)
+	for _, l := range b {
+		in[l] = true
+	}
+	var d []string
+	for _, l := range a {
+		if !in[l] {
+			d = append(d, "-"+l)
+		}
+		delete(in, l)
+	}
+	for _, l := range b {
+		if in[l] {
+			d = append(d, "+"+l)
+		}
+	}
+	return d
+}
+
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
+
+// maxDiffCells bounds the work of lineDiff, beyond which the differing
+// middles of the outputs are shown as wholly replaced.
+const maxDiffCells = 1 << 22
+
+// lineDiff returns the edit script from a to b, as lines prefixed with
+// " ", "-", or "+", using the longest common subsequence of lines.
+func lineDiff(a, b []string) []string {
+	var head, tail []string
+	for len(a) > 0 && len(b) > 0 && a[0] == b[0] {
+		head = append(head, " "+a[0])
+		a, b = a[1:], b[1:]
+	}
+	for len(a) > 0 && len(b) > 0 && a[len(a)-1] == b[len(b)-1] {
+		tail = append([]string{" " + a[len(a)-1]}, tail...)
+		a, b = a[:len(a)-1], b[:len(b)-1]
+	}
+
+	var mid []string
+	if (len(a)+1)*(len(b)+1) > maxDiffCells {
+		for _, l := range a {
+			mid = append(mid, "-"+l)
+		}
+		for _, l := range b {
+			mid = append(mid, "+"+l)
+		}
+		return append(append(head, mid...), tail...)
+	}
+	// lcs[i][j] is the length of the longest common subsequence of a[i:] and b[j:].
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			switch {
+			case a[i] == b[j]:
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			case lcs[i+1][j] >= lcs[i][j+1]:
+				lcs[i][j] = lcs[i+1][j]
+			default:
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			mid = append(mid, " "+a[i])
+			i, j = i+1, j+1
+		case j == len(b) || i < len(a) && lcs[i+1][j] >= lcs[i][j+1]:
+			mid = append(mid, "-"+a[i])
+			i++
+		default:
+			mid = append(mid, "+"+b[j])
+			j++
+		}
+	}
+	return append(append(head, mid...), tail...)
+}
+
+// printLineDiff prints the changed lines from a to b with diffContext
+// lines around them, and ... where unchanged lines are left out.
+func printLineDiff(out io.Writer, a, b []string) {
+	d := lineDiff(a, b)
+	show := make([]bool, len(d))
+	for i, l := range d {
+		if l[0] == ' ' {
+			continue
+		}
+		for k := i - diffContext; k <= i+diffContext; k++ {
+			if k >= 0 && k < len(d) {
+				show[k] = true
+			}
+		}
+	}
+	skipped := false
+	for i, l := range d {
+		if !show[i] {
+			skipped = true
+			continue
+		}
+		if skipped {
+			fmt.Fprintln(out, "...")
+			skipped = false
+		}
+		fmt.Fprintln(out, l)
+	}
+	if skipped {
+		fmt.Fprintln(out, "...")
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+var (
+	explainEvents = flag.Bool("explain", false, "Log what was decided about each file system event, and why")
+	explainFormat = flag.String("explain-format", "text", "The format of -explain: text or json")
+)
+
+// An explanation is a decision about an event, logged with -explain.
+type explanation struct {
+	Time     time.Time `json:"time"`
+	Path     string    `json:"path"`
+	Op       string    `json:"op,omitempty"`
+	Decision string    `json:"decision"`
+	Detail   string    `json:"detail,omitempty"`
+}
+
+// explain logs the decision about the event for path with -explain, and
+// sends it to the simulation of the event, if any.
+// The decisions are excluded, ignored, queued, deduplicated, waiting,
+// declined, streamed, and ran.
+func explain(path string, op fsnotify.Op, decision, detail string, vals ...interface{}) {
+	if !*explainEvents && !simulating(path) {
+		return
+	}
+	e := explanation{
+		Time:     time.Now(),
+		Path:     path,
+		Decision: decision,
+		Detail:   fmt.Sprintf(detail, vals...),
+	}
+	if op != 0 {
+		e.Op = strings.ToLower(op.String())
+	}
+	sendSimulation(e)
+	if !*explainEvents {
+		return
+	}
+	if *explainFormat == "json" {
+		b, _ := json.Marshal(e)
+		fmt.Fprintf(os.Stderr, "%s\n", b)
+		return
+	}
+	fmt.Fprintln(os.Stderr, "explain: "+e.text())
+}
+
+// text describes the decision in a line.
+func (e explanation) text() string {
+	msg := e.Path
+	if e.Op != "" {
+		msg += " (" + e.Op + ")"
+	}
+	msg += ": " + e.Decision
+	if e.Detail != "" {
+		msg += ": " + e.Detail
+	}
+	return msg
+}
+
+// explainAll logs the same decision about each of the changes.
+func explainAll(changes []change, decision, detail string, vals ...interface{}) {
+	for _, c := range changes {
+		explain(c.path, c.op, decision, detail, vals...)
+	}
+}
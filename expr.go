@@ -0,0 +1,285 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// An expr is a compiled filter expression, in a small language with
+// string and boolean values:
+//
+//	path.endsWith('.go') && !path.contains('_gen') && event != 'chmod'
+//
+// The variables are path, name (the base name of the path), ext (the
+// extension, with its dot), dir, and event (create, write, remove,
+// rename, or chmod). An event with several ops, such as a create and a
+// write, passes if the expression is true for any one of them. Strings have the methods startsWith, endsWith,
+// contains, and matches, which takes a regular expression. The operators
+// are ==, !=, !, &&, and ||, and parentheses group.
+type expr func(vars map[string]string) interface{}
+
+// exprOps are the ops an event may have, each of which event is bound to in turn.
+var exprOps = []fsnotify.Op{fsnotify.Create, fsnotify.Write, fsnotify.Remove, fsnotify.Rename, fsnotify.Chmod}
+
+// eventVars returns the variables of an expression for ev, with event
+// bound to op, one of its ops.
+func eventVars(ev fsnotify.Event, op fsnotify.Op) map[string]string {
+	return map[string]string{
+		"path":  filepath.ToSlash(ev.Name),
+		"name":  filepath.Base(ev.Name),
+		"ext":   filepath.Ext(ev.Name),
+		"dir":   filepath.ToSlash(filepath.Dir(ev.Name)),
+		"event": strings.ToLower(op.String()),
+	}
+}
+
+// holds reports whether the expression is true for ev with event bound
+// to any one of its ops.
+func (e expr) holds(ev fsnotify.Event) bool {
+	for _, op := range exprOps {
+		if ev.Op&op != 0 && e(eventVars(ev, op)).(bool) {
+			return true
+		}
+	}
+	return ev.Op == 0 && e(eventVars(ev, 0)).(bool)
+}
+
+var exprVars = map[string]bool{"path": true, "name": true, "ext": true, "dir": true, "event": true}
+
+// compileExpr compiles a boolean expression.
+func compileExpr(s string) (expr, error) {
+	p := &exprParser{s: s}
+	if err := p.lex(); err != nil {
+		return nil, err
+	}
+	e, t, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.toks) {
+		return nil, p.errorf("unexpected %s", p.toks[p.pos])
+	}
+	if t != "bool" {
+		return nil, fmt.Errorf("expression is a %s, not a bool", t)
+	}
+	return e, nil
+}
+
+type exprParser struct {
+	s    string
+	toks []string
+	pos  int
+}
+
+func (p *exprParser) errorf(f string, vals ...interface{}) error {
+	return fmt.Errorf("in %q: "+f, append([]interface{}{p.s}, vals...)...)
+}
+
+// lex splits the expression into tokens. String tokens keep their
+// quotes, to tell them from identifiers.
+func (p *exprParser) lex() error {
+	s := p.s
+	for i := 0; i < len(s); {
+		c := rune(s[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '\'' || c == '"':
+			j := i + 1
+			var b strings.Builder
+			for ; j < len(s) && rune(s[j]) != c; j++ {
+				if s[j] == '\\' && j+1 < len(s) {
+					j++
+				}
+				b.WriteByte(s[j])
+			}
+			if j == len(s) {
+				return p.errorf("unterminated string")
+			}
+			p.toks = append(p.toks, "'"+b.String())
+			i = j + 1
+		case unicode.IsLetter(c) || c == '_':
+			j := i
+			for j < len(s) && (unicode.IsLetter(rune(s[j])) || unicode.IsDigit(rune(s[j])) || s[j] == '_') {
+				j++
+			}
+			p.toks = append(p.toks, s[i:j])
+			i = j
+		default:
+			if i+1 < len(s) {
+				if op := s[i : i+2]; op == "&&" || op == "||" || op == "==" || op == "!=" {
+					p.toks = append(p.toks, op)
+					i += 2
+					continue
+				}
+			}
+			if !strings.ContainsRune("!().,", c) {
+				return p.errorf("unexpected %q", c)
+			}
+			p.toks = append(p.toks, string(c))
+			i++
+		}
+	}
+	return nil
+}
+
+func (p *exprParser) peek() string {
+	if p.pos < len(p.toks) {
+		return p.toks[p.pos]
+	}
+	return ""
+}
+
+func (p *exprParser) expect(tok string) error {
+	if p.peek() != tok {
+		return p.errorf("expected %s", tok)
+	}
+	p.pos++
+	return nil
+}
+
+func (p *exprParser) or() (expr, string, error) {
+	return p.binary("||", p.and)
+}
+
+func (p *exprParser) and() (expr, string, error) {
+	return p.binary("&&", p.compare)
+}
+
+// binary parses a chain of the boolean operator op.
+func (p *exprParser) binary(op string, next func() (expr, string, error)) (expr, string, error) {
+	l, t, err := next()
+	if err != nil {
+		return nil, "", err
+	}
+	for p.peek() == op {
+		p.pos++
+		r, rt, err := next()
+		if err != nil {
+			return nil, "", err
+		}
+		if t != "bool" || rt != "bool" {
+			return nil, "", p.errorf("%s needs bools", op)
+		}
+		a := l
+		if op == "&&" {
+			l = func(v map[string]string) interface{} { return a(v).(bool) && r(v).(bool) }
+		} else {
+			l = func(v map[string]string) interface{} { return a(v).(bool) || r(v).(bool) }
+		}
+	}
+	return l, t, nil
+}
+
+func (p *exprParser) compare() (expr, string, error) {
+	l, t, err := p.unary()
+	if err != nil {
+		return nil, "", err
+	}
+	if op := p.peek(); op == "==" || op == "!=" {
+		p.pos++
+		r, rt, err := p.unary()
+		if err != nil {
+			return nil, "", err
+		}
+		if t != rt {
+			return nil, "", p.errorf("cannot compare a %s to a %s", t, rt)
+		}
+		want := op == "=="
+		return func(v map[string]string) interface{} { return (l(v) == r(v)) == want }, "bool", nil
+	}
+	return l, t, nil
+}
+
+func (p *exprParser) unary() (expr, string, error) {
+	if p.peek() == "!" {
+		p.pos++
+		e, t, err := p.unary()
+		if err != nil {
+			return nil, "", err
+		}
+		if t != "bool" {
+			return nil, "", p.errorf("! needs a bool")
+		}
+		return func(v map[string]string) interface{} { return !e(v).(bool) }, "bool", nil
+	}
+	return p.call()
+}
+
+// call parses an operand followed by any method calls.
+func (p *exprParser) call() (expr, string, error) {
+	e, t, err := p.operand()
+	if err != nil {
+		return nil, "", err
+	}
+	for p.peek() == "." {
+		p.pos++
+		name := p.peek()
+		p.pos++
+		if err := p.expect("("); err != nil {
+			return nil, "", err
+		}
+		// Arguments must be literals, so regular expressions compile once.
+		arg := p.peek()
+		if !strings.HasPrefix(arg, "'") {
+			return nil, "", p.errorf("%s takes a string literal", name)
+		}
+		p.pos++
+		if err := p.expect(")"); err != nil {
+			return nil, "", err
+		}
+		if t != "string" {
+			return nil, "", p.errorf("%s is a string method", name)
+		}
+		arg = arg[1:]
+		var f func(string) bool
+		switch name {
+		case "startsWith":
+			f = func(s string) bool { return strings.HasPrefix(s, arg) }
+		case "endsWith":
+			f = func(s string) bool { return strings.HasSuffix(s, arg) }
+		case "contains":
+			f = func(s string) bool { return strings.Contains(s, arg) }
+		case "matches":
+			re, err := regexp.Compile(arg)
+			if err != nil {
+				return nil, "", p.errorf("%s", err)
+			}
+			f = re.MatchString
+		default:
+			return nil, "", p.errorf("unknown method %s", name)
+		}
+		s := e
+		e, t = func(v map[string]string) interface{} { return f(s(v).(string)) }, "bool"
+	}
+	return e, t, nil
+}
+
+func (p *exprParser) operand() (expr, string, error) {
+	tok := p.peek()
+	p.pos++
+	switch {
+	case tok == "":
+		return nil, "", p.errorf("unexpected end")
+	case tok == "(":
+		e, t, err := p.or()
+		if err != nil {
+			return nil, "", err
+		}
+		return e, t, p.expect(")")
+	case strings.HasPrefix(tok, "'"):
+		s := tok[1:]
+		return func(map[string]string) interface{} { return s }, "string", nil
+	case tok == "true" || tok == "false":
+		b := tok == "true"
+		return func(map[string]string) interface{} { return b }, "bool", nil
+	case exprVars[tok]:
+		return func(v map[string]string) interface{} { return v[tok] }, "string", nil
+	}
+	return nil, "", p.errorf("unexpected %s", tok)
+}
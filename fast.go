@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+)
+
+var fastRules []fastRule
+
+func init() {
+	flag.Var((*fastRuleList)(&fastRules), "fast", "A glob and a quicker command to run, with the changed files matching the glob as arguments, instead of the command when all changed files match fast rules, such as '*.md=markdownlint' (may be repeated)")
+}
+
+// A fastRule runs a quick check, such as a linter, on the files matching
+// its glob, in place of the full command.
+type fastRule struct {
+	glob string
+	args []string
+}
+
+type fastRuleList []fastRule
+
+func (l *fastRuleList) String() string {
+	var s []string
+	for _, r := range *l {
+		s = append(s, r.glob+"="+strings.Join(r.args, " "))
+	}
+	return strings.Join(s, ",")
+}
+
+func (l *fastRuleList) Set(s string) error {
+	i := strings.IndexByte(s, '=')
+	if i <= 0 {
+		return fmt.Errorf("%q is not of the form glob=command", s)
+	}
+	args := strings.Fields(s[i+1:])
+	if len(args) == 0 {
+		return fmt.Errorf("%q has no command", s)
+	}
+	*l = append(*l, fastRule{glob: s[:i], args: args})
+	return nil
+}
+
+// A fastRun is a fast rule and the changed files it applies to.
+type fastRun struct {
+	rule  fastRule
+	files []string
+}
+
+// fastRuns returns the fast rules to run instead of the command, with
+// the files for each, and reports whether every changed file matches one.
+// A file is given to the first rule it matches. Files that no longer
+// exist are left out, but still count as matched.
+func fastRuns(changes []change) ([]fastRun, bool) {
+	if len(fastRules) == 0 || len(changes) == 0 {
+		return nil, false
+	}
+	runs := make([]fastRun, len(fastRules))
+	for i, r := range fastRules {
+		runs[i].rule = r
+	}
+	for _, p := range (runResult{changes: changes}).files() {
+		i := 0
+		for i < len(fastRules) && !matchGlob(fastRules[i].glob, p) {
+			i++
+		}
+		if i == len(fastRules) {
+			return nil, false
+		}
+		if exists(p) {
+			runs[i].files = append(runs[i].files, p)
+		}
+	}
+	var used []fastRun
+	for _, r := range runs {
+		if len(r.files) > 0 {
+			used = append(used, r)
+		}
+	}
+	return used, true
+}
+
+// runFast runs the rule's command on its files, reporting whether it
+// succeeded. It is killed if ctx is canceled.
+func runFast(ctx context.Context, out io.Writer, r fastRun) bool {
+	args := append(append([]string(nil), r.rule.args...), r.files...)
+	io.WriteString(out, "fast: "+strings.Join(args, " ")+"\n")
+	if err := checkAllowed(args[0]); err != nil {
+		io.WriteString(out, "fatal: "+err.Error()+"\n")
+		return false
+	}
+	if err := runStep(ctx, out, "fast", args); err != nil {
+		io.WriteString(out, "fast: "+err.Error()+"\n")
+		return false
+	}
+	return true
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+var fifoPath = flag.String("fifo", "", "Treat each line written to this named pipe as a change, to the path on the line if any; the pipe is created if needed")
+
+var errNotFIFO = errors.New("not a named pipe")
+
+// readFIFO sends a change for each line written to the named pipe at p,
+// reopening it whenever its writers have all closed it.
+func readFIFO(p string, changes chan<- change) {
+	for {
+		// Opening blocks until there is a writer.
+		f, err := os.Open(p)
+		if err != nil {
+			log.Printf("Failed to open %s: %s", p, err)
+			return
+		}
+		sc := bufio.NewScanner(f)
+		for sc.Scan() {
+			path := strings.TrimSpace(sc.Text())
+			if path == "" {
+				path = p
+			}
+			debugPrint("%s from %s", path, p)
+			changes <- change{time: time.Now(), path: path, op: fsnotify.Write}
+		}
+		if err := sc.Err(); err != nil {
+			log.Printf("Failed to read %s: %s", p, err)
+		}
+		f.Close()
+	}
+}
+
+// setupFIFO creates the named pipe at p, unless it exists already.
+func setupFIFO(p string) error {
+	switch fi, err := os.Stat(p); {
+	case os.IsNotExist(err):
+		if err := mkfifo(p); err != nil {
+			return err
+		}
+		atExit(func() { os.Remove(p) })
+		return nil
+	case err != nil:
+		return err
+	case fi.Mode()&os.ModeNamedPipe == 0:
+		return &os.PathError{Op: "fifo", Path: p, Err: errNotFIFO}
+	}
+	return nil
+}
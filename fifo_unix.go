@@ -0,0 +1,16 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+func mkfifo(p string) error {
+	if err := syscall.Mkfifo(p, 0600); err != nil {
+		return &os.PathError{Op: "mkfifo", Path: p, Err: err}
+	}
+	return nil
+}
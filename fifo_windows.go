@@ -0,0 +1,13 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+func mkfifo(p string) error {
+	return &os.PathError{Op: "mkfifo", Path: p, Err: errors.New("named pipes are not supported on Windows")}
+}
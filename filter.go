@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+var (
+	maxFileSize = flag.String("max-file-size", "", "Ignore changes to files larger than this size, e.g. 10M")
+	skipBinary  = flag.Bool("skip-binary", false, "Ignore changes to binary files, such as images, archives and compiled artifacts")
+	extensions  = flag.String("e", "", "Comma-separated list of file extensions to watch, e.g. go,mod,tmpl")
+	appear      = flag.String("appear", "", "Only run when a file matching this glob is created, not on start")
+	condition   = flag.String("if", "", "Only run for changes for which this expression is true, e.g. \"ext == '.go' && event != 'chmod'\"; an event with several ops passes if it is true for any of them")
+	structure   = flag.Bool("structure", false, "Only run when files are created, removed or renamed, not when they are written")
+	include     = flag.String("i", "", "Only run for files matching this regular expression, and only watch directories with such files")
+)
+
+// includeRe is the compiled -i, if any.
+var includeRe *regexp.Regexp
+
+// hasIncludes reports whether -i or -g restrict the files that trigger runs.
+func hasIncludes() bool {
+	filtersMu.RLock()
+	defer filtersMu.RUnlock()
+	return includeRe != nil || len(includeGlobs) > 0
+}
+
+// included reports whether p matches -i and -g, where given.
+func included(p string) bool {
+	return (includeRe == nil || includeRe.MatchString(p)) && globIncluded(p)
+}
+
+func init() {
+	flag.StringVar(extensions, "ext", "", "The same as -e")
+}
+
+// onlyExts is the set of extensions from -e, with their leading dots,
+// or nil to allow all.
+var onlyExts map[string]bool
+
+// conditionExpr is the compiled -if expression, if any.
+var conditionExpr expr
+
+// maxFileBytes is the parsed -max-file-size, or 0 for no limit.
+var maxFileBytes int64
+
+// binaryExts are the extensions of files taken to be binary without
+// reading them, which also covers files that have been removed.
+var binaryExts = map[string]bool{
+	".a": true, ".o": true, ".so": true, ".dylib": true, ".dll": true, ".exe": true,
+	".class": true, ".jar": true, ".pyc": true, ".wasm": true,
+	".zip": true, ".tar": true, ".gz": true, ".tgz": true, ".bz2": true, ".xz": true, ".7z": true,
+	".png": true, ".jpg": true, ".jpeg": true, ".gif": true, ".ico": true, ".webp": true, ".pdf": true,
+	".woff": true, ".woff2": true, ".ttf": true, ".otf": true,
+	".mp3": true, ".mp4": true, ".mov": true, ".wav": true,
+}
+
+// sniffLen is how much of a file is read to look for a null byte.
+const sniffLen = 8000
+
+// setupFilters parses the flags of the change filters.
+func setupFilters() error {
+	if *explainFormat != "text" && *explainFormat != "json" {
+		return fmt.Errorf("unknown -explain-format %q", *explainFormat)
+	}
+	if *maxFileSize != "" {
+		n, err := parseSize(*maxFileSize)
+		if err != nil {
+			return err
+		}
+		maxFileBytes = n
+	}
+	if *appear != "" {
+		if _, err := filepath.Match(*appear, ""); err != nil {
+			return fmt.Errorf("invalid -appear pattern %q: %s", *appear, err)
+		}
+	}
+	if *include != "" {
+		re, err := regexp.Compile(normName(*include))
+		if err != nil {
+			return fmt.Errorf("invalid -i: %s", err)
+		}
+		includeRe = re
+	}
+	if err := setupGlobs(); err != nil {
+		return err
+	}
+	if *condition != "" {
+		e, err := compileExpr(*condition)
+		if err != nil {
+			return fmt.Errorf("invalid -if: %s", err)
+		}
+		conditionExpr = e
+	}
+	if *extensions != "" {
+		onlyExts = make(map[string]bool)
+		for _, e := range strings.Split(*extensions, ",") {
+			if e = strings.TrimPrefix(strings.TrimSpace(e), "."); e != "" {
+				onlyExts["."+e] = true
+			}
+		}
+	}
+	return nil
+}
+
+// ignoreReason returns why a change to a watched file should not
+// trigger a run, or "" if it should. Changes to excluded files are
+// dropped earlier, since their directories are not watched either.
+func ignoreReason(ev fsnotify.Event) string {
+	if isAssetOutput(ev.Name) {
+		return "built asset in -assets"
+	}
+	if isTemplateOutput(ev.Name) {
+		return "rendered to -templates-out"
+	}
+	if *appear != "" && (ev.Op&fsnotify.Create == 0 || !matchGlob(*appear, ev.Name)) {
+		return "not the appearance of " + *appear
+	}
+	if *structure && ev.Op&(fsnotify.Create|fsnotify.Remove|fsnotify.Rename) == 0 {
+		return "not a structural change"
+	}
+	if includeRe != nil && !includeRe.MatchString(ev.Name) {
+		return "does not match -i"
+	}
+	if !globIncluded(ev.Name) {
+		return "does not match -g"
+	}
+	if onlyExts != nil && !onlyExts[filepath.Ext(ev.Name)] {
+		return "extension not in -e"
+	}
+	if conditionExpr != nil && !conditionExpr.holds(ev) {
+		return "-if is false"
+	}
+	if *skipBinary && binaryExts[strings.ToLower(filepath.Ext(ev.Name))] {
+		return "binary file"
+	}
+	if why := contentIgnoreReason(ev); why != "" {
+		return why
+	}
+	return pluginIgnoreReason(ev)
+}
+
+// contentIgnoreReason returns why the written file should be
+// ignored for its size or contents, or "".
+func contentIgnoreReason(ev fsnotify.Event) string {
+	if ev.Op&(fsnotify.Create|fsnotify.Write) == 0 || (maxFileBytes == 0 && !*skipBinary) {
+		return ""
+	}
+
+	fi, err := os.Stat(ev.Name)
+	switch {
+	case os.IsNotExist(err):
+		return ""
+	case err != nil:
+		log.Printf("Failed to check %s: %s", ev.Name, err)
+		return ""
+	case !fi.Mode().IsRegular():
+		return ""
+	case maxFileBytes > 0 && fi.Size() > maxFileBytes:
+		return fmt.Sprintf("larger than %s", *maxFileSize)
+	case *skipBinary && isBinary(ev.Name):
+		return "binary file"
+	}
+	return ""
+}
+
+// isBinary reports whether the start of the file contains a null byte,
+// which text files do not.
+func isBinary(name string) bool {
+	f, err := os.Open(name)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	buf := make([]byte, sniffLen)
+	n, _ := io.ReadFull(f, buf)
+	return bytes.IndexByte(buf[:n], 0) >= 0
+}
@@ -0,0 +1,48 @@
+package main
+
+// followUps decides whether the changes made during a run call for
+// another run. They do, unless the command made them itself: files that
+// change during a run and then again during the run that follows it are
+// taken to be the command's own output, such as a binary it builds.
+type followUps struct {
+	// last are the files that called for the last follow-up run.
+	last map[string]bool
+	// own are the files taken to be written by the command.
+	own map[string]bool
+}
+
+// changed forgets that p is the command's own output, since it changed
+// while the command was not running.
+func (f *followUps) changed(p string) {
+	delete(f.own, p)
+}
+
+// filter splits the changes made during a run into those that call for
+// a follow-up run and those made by the command.
+func (f *followUps) filter(changes []change) (follow, own []change) {
+	if f.own == nil {
+		f.own = make(map[string]bool)
+	}
+	files := (runResult{changes: changes}).files()
+	again := len(f.last) > 0
+	for _, p := range files {
+		if !f.last[p] && !f.own[p] {
+			again = false
+		}
+	}
+	if again {
+		for _, p := range files {
+			f.own[p] = true
+		}
+	}
+	f.last = make(map[string]bool)
+	for _, c := range changes {
+		if f.own[c.path] {
+			own = append(own, c)
+			continue
+		}
+		follow = append(follow, c)
+		f.last[c.path] = true
+	}
+	return follow, own
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+var fuzzMode = flag.Bool("fuzz", false, "When inputs appear in a testdata/fuzz corpus, such as crashers found by go test -fuzz, check the fuzz test's seed corpus with go test -run before the command, and instead of it if only corpus inputs changed")
+
+// A fuzzTarget is a fuzz test, by the directory of its package and its name.
+type fuzzTarget struct {
+	dir, name string
+}
+
+// corpusTarget returns the fuzz test whose seed corpus p is an input
+// of, as in dir/testdata/fuzz/FuzzName/input.
+func corpusTarget(p string) (fuzzTarget, bool) {
+	parts := strings.Split(filepath.ToSlash(p), "/")
+	n := len(parts)
+	if n < 4 || parts[n-4] != "testdata" || parts[n-3] != "fuzz" || !strings.HasPrefix(parts[n-2], "Fuzz") {
+		return fuzzTarget{}, false
+	}
+	// Up from the input, its test, fuzz, and testdata, keeping the root
+	// of an absolute path.
+	dir := filepath.Dir(filepath.Dir(filepath.Dir(filepath.Dir(p))))
+	return fuzzTarget{dir, parts[n-2]}, true
+}
+
+// packagePath returns the go command's argument for the package in dir.
+// A relative one needs a leading ./ not to be taken for an import path.
+func packagePath(dir string) string {
+	if filepath.IsAbs(dir) {
+		return dir
+	}
+	return "./" + filepath.ToSlash(dir)
+}
+
+// fuzzTargets returns the fuzz tests with new or changed inputs among
+// the changes, and whether the changes are all such inputs.
+func fuzzTargets(changes []change) (targets []fuzzTarget, only bool) {
+	seen := make(map[fuzzTarget]bool)
+	only = len(changes) > 0
+	for _, c := range changes {
+		t, ok := corpusTarget(c.path)
+		if !ok {
+			only = false
+			continue
+		}
+		if c.op&(fsnotify.Create|fsnotify.Write) == 0 || seen[t] {
+			continue
+		}
+		seen[t] = true
+		targets = append(targets, t)
+	}
+	sort.Slice(targets, func(i, j int) bool {
+		if targets[i].dir != targets[j].dir {
+			return targets[i].dir < targets[j].dir
+		}
+		return targets[i].name < targets[j].name
+	})
+	return targets, only && len(targets) > 0
+}
+
+// runFuzzSeeds runs the fuzz tests on their seed corpora, reporting
+// whether they all passed. They are killed if ctx is canceled.
+func runFuzzSeeds(ctx context.Context, out io.Writer, targets []fuzzTarget) bool {
+	if err := checkAllowed("go"); err != nil {
+		io.WriteString(out, "fatal: "+err.Error()+"\n")
+		return false
+	}
+	ok := true
+	for _, t := range targets {
+		args := []string{"go", "test", "-run", "^" + t.name + "$", packagePath(t.dir)}
+		io.WriteString(out, "fuzz: "+strings.Join(args, " ")+"\n")
+		if err := runStep(ctx, out, "fuzz", args); err != nil {
+			io.WriteString(out, "fuzz: "+err.Error()+"\n")
+			ok = false
+		}
+	}
+	return ok
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var goGenerate = flag.Bool("go-generate", false, "Run go generate before the command in the packages with //go:generate directives whose Go files changed")
+
+// generatedRe matches the comment marking a generated Go file.
+var generatedRe = regexp.MustCompile(`^// Code generated .* DO NOT EDIT\.$`)
+
+// isGenerated reports whether the Go file p is marked as generated
+// before its package clause.
+func isGenerated(p string) bool {
+	f, err := os.Open(p)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		l := sc.Text()
+		if generatedRe.MatchString(l) {
+			return true
+		}
+		if strings.HasPrefix(l, "package ") {
+			return false
+		}
+	}
+	return false
+}
+
+// isGenerateInput reports whether p is a Go file written by hand,
+// a change to which may call for go generate to run.
+func isGenerateInput(p string) bool {
+	return strings.HasSuffix(p, ".go") && !isGenerated(p)
+}
+
+// hasGenerate reports whether a Go file in dir has a //go:generate directive.
+func hasGenerate(dir string) bool {
+	ents, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return false
+	}
+	for _, e := range ents {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".go") {
+			continue
+		}
+		b, err := ioutil.ReadFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			continue
+		}
+		for _, l := range strings.Split(string(b), "\n") {
+			if strings.HasPrefix(l, "//go:generate ") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// generatePackages returns the directories of the packages with
+// go:generate directives in which Go files written by hand changed,
+// with -go-generate.
+func generatePackages(changes []change) []string {
+	if !*goGenerate {
+		return nil
+	}
+	seen := make(map[string]bool)
+	var dirs []string
+	for _, c := range changes {
+		dir := filepath.Dir(c.path)
+		if seen[dir] || !isGenerateInput(c.path) {
+			continue
+		}
+		seen[dir] = true
+		if hasGenerate(dir) {
+			dirs = append(dirs, dir)
+		}
+	}
+	sort.Strings(dirs)
+	return dirs
+}
+
+// runGoGenerate runs go generate in the packages, reporting whether it
+// succeeded in all of them. It is killed if ctx is canceled.
+func runGoGenerate(ctx context.Context, out io.Writer, dirs []string) bool {
+	if err := checkAllowed("go"); err != nil {
+		io.WriteString(out, "fatal: "+err.Error()+"\n")
+		return false
+	}
+	ok := true
+	for _, dir := range dirs {
+		pkg := packagePath(dir)
+		io.WriteString(out, "generate: go generate "+pkg+"\n")
+		if err := runStep(ctx, out, "generate", []string{"go", "generate", pkg}); err != nil {
+			io.WriteString(out, "generate: "+err.Error()+"\n")
+			ok = false
+		}
+	}
+	return ok
+}
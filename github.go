@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+)
+
+var (
+	githubStatus  = flag.Bool("github-status", false, "Report each run as a commit status on HEAD using $GITHUB_TOKEN")
+	githubContext = flag.String("github-context", "watch", "The context name of -github-status commit statuses")
+)
+
+// githubRemoteRe matches the owner and repository of
+// SSH and HTTPS GitHub remote URLs.
+var githubRemoteRe = regexp.MustCompile(`github\.com[:/]([^/]+)/([^/]+?)(\.git)?/?$`)
+
+// A githubReporter reports runs as GitHub commit statuses.
+type githubReporter struct {
+	api, token string
+	repo       string // owner/name
+	sha        string // the commit of the current run
+	statuses   chan githubCommitStatus
+}
+
+type githubCommitStatus struct {
+	sha         string
+	State       string `json:"state"`
+	Description string `json:"description"`
+	Context     string `json:"context"`
+}
+
+// newGithubReporter returns a githubReporter for the -github-status
+// flag, or nil if commit statuses were not requested.
+func newGithubReporter() (reporter, error) {
+	if !*githubStatus {
+		return nil, nil
+	}
+	token := os.Getenv("GITHUB_TOKEN")
+	if token == "" {
+		return nil, errors.New("-github-status requires $GITHUB_TOKEN")
+	}
+	out, err := exec.Command("git", "remote", "get-url", "origin").Output()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to find the origin remote: %s", err)
+	}
+	m := githubRemoteRe.FindStringSubmatch(strings.TrimSpace(string(out)))
+	if m == nil {
+		return nil, fmt.Errorf("The origin remote is not on GitHub: %s", strings.TrimSpace(string(out)))
+	}
+	api := os.Getenv("GITHUB_API_URL")
+	if api == "" {
+		api = "https://api.github.com"
+	}
+	g := &githubReporter{
+		api:      strings.TrimSuffix(api, "/"),
+		token:    token,
+		repo:     m[1] + "/" + m[2],
+		statuses: make(chan githubCommitStatus, 16),
+	}
+	go g.loop()
+	return g, nil
+}
+
+func (g *githubReporter) started(r runResult) {
+	out, err := exec.Command("git", "rev-parse", "HEAD").Output()
+	if err != nil {
+		log.Printf("Failed to find HEAD: %s", err)
+		g.sha = ""
+		return
+	}
+	g.sha = strings.TrimSpace(string(out))
+	g.send(r, "pending", strings.Join(r.args, " ")+" is running")
+}
+
+func (g *githubReporter) finished(r runResult) {
+	st := newRunStatus(r)
+	state := "success"
+	if r.status != 0 {
+		state = "failure"
+	}
+	g.send(r, state, fmt.Sprintf("%s: %s in %s", st.Command, st.State, st.Duration))
+}
+
+// send queues a status for the run. A rule's runs have a context of
+// their own, so as not to replace the command's status.
+func (g *githubReporter) send(r runResult, state, desc string) {
+	if g.sha == "" {
+		return
+	}
+	// GitHub rejects descriptions longer than 140 characters.
+	if r := []rune(desc); len(r) > 140 {
+		desc = string(r[:139]) + "…"
+	}
+	ctx := *githubContext
+	if r.rule != "" {
+		ctx += "/" + r.rule
+	}
+	select {
+	case g.statuses <- githubCommitStatus{sha: g.sha, State: state, Description: desc, Context: ctx}:
+	default:
+		debugPrint("dropping GitHub status for %s", g.sha)
+	}
+}
+
+// loop posts statuses in order, so that a run's
+// result never arrives before its pending status.
+func (g *githubReporter) loop() {
+	for st := range g.statuses {
+		if err := g.post(st); err != nil {
+			log.Printf("Failed to report GitHub status: %s", err)
+		}
+	}
+}
+
+func (g *githubReporter) post(st githubCommitStatus) error {
+	body, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	url := fmt.Sprintf("%s/repos/%s/statuses/%s", g.api, g.repo, st.sha)
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "token "+g.token)
+	req.Header.Set("Accept", "application/vnd.github.v3+json")
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return errors.New(resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// globArgs are the shell-style globs given with -g.
+var globArgs stringList
+
+func init() {
+	flag.Var(&globArgs, "g", "Only run for files matching this glob, such as '**/*.go', or with a leading !, never for those matching it, such as '!build/**'; may be repeated")
+}
+
+// A globRule is a compiled -g glob. Globs with a slash match the whole
+// path, and others just the name, as in .gitignore files.
+type globRule struct {
+	glob string
+	re   *regexp.Regexp
+	name bool // whether it matches just the name
+}
+
+func (g globRule) match(p string) bool {
+	if g.name {
+		p = p[strings.LastIndexByte(p, '/')+1:]
+	}
+	return g.re.MatchString(p)
+}
+
+// includeGlobs and excludeGlobs are the compiled -g globs, guarded by
+// filtersMu as they change on reloading the configuration.
+var includeGlobs, excludeGlobs []globRule
+
+// setupGlobs compiles the -g globs.
+func setupGlobs() error {
+	var includes, excludes []globRule
+	for _, a := range globArgs {
+		glob := strings.TrimPrefix(a, "!")
+		g := globRule{glob: a, name: !strings.Contains(glob, "/")}
+		re, err := regexp.Compile("^" + globRegexp(strings.TrimPrefix(glob, "./")) + "$")
+		if err != nil {
+			return fmt.Errorf("invalid -g %q: %s", a, err)
+		}
+		g.re = re
+		if strings.HasPrefix(a, "!") {
+			excludes = append(excludes, g)
+		} else {
+			includes = append(includes, g)
+		}
+	}
+	filtersMu.Lock()
+	includeGlobs, excludeGlobs = includes, excludes
+	filtersMu.Unlock()
+	return nil
+}
+
+// globExcludedBy returns the -g glob that excludes p, if any. The caller
+// holds filtersMu.
+func globExcludedBy(p string) string {
+	for _, g := range excludeGlobs {
+		if g.match(p) {
+			return g.glob
+		}
+	}
+	return ""
+}
+
+// globIncluded reports whether p matches one of the including -g globs,
+// if there are any.
+func globIncluded(p string) bool {
+	filtersMu.RLock()
+	defer filtersMu.RUnlock()
+	if len(includeGlobs) == 0 {
+		return true
+	}
+	for _, g := range includeGlobs {
+		if g.match(p) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	goMode    = flag.Bool("go", false, "Also watch go.mod and go.sum of the Go module being watched, even if they are outside the watched path, or all modules of its workspace")
+	goReplace = flag.Bool("go-replace", false, "With -go, also watch the local directories that go.mod replaces modules with")
+)
+
+// goWorkExclude is the default -x in a workspace, excluding the
+// directories that no member module builds from. Not testdata, which
+// tests read, and which holds the seed corpora -fuzz watches.
+const goWorkExclude = `(^|/)(\.git|vendor|node_modules)(/|$)`
+
+// findUp returns the file named name in dir or the nearest of its
+// parents, or "".
+func findUp(dir, name string) string {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return ""
+	}
+	for {
+		p := filepath.Join(dir, name)
+		if _, err := os.Stat(p); err == nil {
+			return p
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+// findGoMod returns the go.mod of the module containing dir, or "".
+func findGoMod(dir string) string {
+	return findUp(dir, "go.mod")
+}
+
+// findGoWork returns the go.work of the workspace containing dir, or "".
+// Like the go command, it honours $GOWORK.
+func findGoWork(dir string) string {
+	switch w := os.Getenv("GOWORK"); w {
+	case "off":
+		return ""
+	case "":
+		return findUp(dir, "go.work")
+	default:
+		return w
+	}
+}
+
+// goWorkMembers returns the module directories used by the go.work at
+// p, relative to its directory.
+func goWorkMembers(p string) ([]string, error) {
+	uses, err := goModDirectives(p, "use")
+	if err != nil {
+		return nil, err
+	}
+	var dirs []string
+	for _, u := range uses {
+		dirs = append(dirs, filepath.Clean(strings.Trim(u, `"`)))
+	}
+	return dirs, nil
+}
+
+// goModDirectives returns the arguments of the directives named verb in
+// the go.mod or go.work file at p, from both single lines and blocks.
+func goModDirectives(p, verb string) ([]string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var args []string
+	inBlock := false
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := sc.Text()
+		if i := strings.Index(line, "//"); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		switch {
+		case inBlock && line == ")":
+			inBlock = false
+		case inBlock:
+			if line != "" {
+				args = append(args, line)
+			}
+		case line == verb+" (":
+			inBlock = true
+		case strings.HasPrefix(line, verb+" "):
+			args = append(args, strings.TrimSpace(line[len(verb):]))
+		}
+	}
+	return args, sc.Err()
+}
+
+// goReplaceDirs returns the local directories that the go.mod at p
+// replaces modules with.
+func goReplaceDirs(p string) ([]string, error) {
+	reps, err := goModDirectives(p, "replace")
+	if err != nil {
+		return nil, err
+	}
+	var dirs []string
+	for _, r := range reps {
+		i := strings.Index(r, "=>")
+		if i < 0 {
+			continue
+		}
+		fields := strings.Fields(r[i+2:])
+		if len(fields) != 1 {
+			// A module path and version, not a directory.
+			continue
+		}
+		d := strings.Trim(fields[0], `"`)
+		if !filepath.IsAbs(d) && !strings.HasPrefix(d, "./") && !strings.HasPrefix(d, "../") {
+			continue
+		}
+		if !filepath.IsAbs(d) {
+			d = filepath.Join(filepath.Dir(p), d)
+		}
+		dirs = append(dirs, d)
+	}
+	return dirs, nil
+}
+
+// watchGoModule adds the go.mod and go.sum of the module containing dir,
+// and with -go-replace its local replacements, to the watched paths.
+func watchGoModule(dir string) {
+	mod := findGoMod(dir)
+	if mod == "" {
+		debugPrint("No go.mod found for %s", dir)
+		return
+	}
+	for _, p := range []string{mod, filepath.Join(filepath.Dir(mod), "go.sum")} {
+		if err := changeWatch("add-file", p); err != nil && !os.IsNotExist(err) {
+			debugPrint("Failed to watch %s: %s", p, err)
+		}
+	}
+	if !*goReplace {
+		return
+	}
+	dirs, err := goReplaceDirs(mod)
+	if err != nil {
+		debugPrint("Failed to read %s: %s", mod, err)
+		return
+	}
+	for _, d := range dirs {
+		if err := changeWatch("add", d); err != nil {
+			debugPrint("Failed to watch %s: %s", d, err)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+var historySize = flag.Int("history", 0, "Keep the output and changed files of this many of the last runs in the project's state directory, for watch diff and to tell in which run errors first appeared")
+
+// A historyRun is a run kept in the history.
+type historyRun struct {
+	N      int       `json:"n"`
+	Args   []string  `json:"args"`
+	Reason string    `json:"reason"`
+	Start  time.Time `json:"start"`
+	End    time.Time `json:"end"`
+	Status int       `json:"status"`
+	Files  []string  `json:"files,omitempty"`
+	Stdout string    `json:"stdout,omitempty"`
+	Stderr string    `json:"stderr,omitempty"`
+	// Errors are the distinct errors the run reported, by errorKey.
+	Errors []string `json:"errors,omitempty"`
+	// Capture is the state of the toolchain and environment, with -capture.
+	Capture *runCapture `json:"capture,omitempty"`
+	// Rule is the label of the -rule whose command ran, if not the command.
+	Rule string `json:"rule,omitempty"`
+}
+
+// errorKey identifies an error across runs, in which its line may move.
+func errorKey(d diagnostic) string {
+	return d.File + ": " + d.Message
+}
+
+// runErrors returns the keys of the distinct errors among the
+// diagnostics, in order.
+func runErrors(diags []diagnostic) []string {
+	var keys []string
+	seen := make(map[string]bool)
+	for _, d := range diags {
+		if k := errorKey(d); !d.warning() && !seen[k] {
+			seen[k] = true
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+// A history keeps the last runs in the project's state directory,
+// each in a file named by its number, which counts up across sessions.
+type history struct {
+	dir  string
+	next int
+	// first are the runs in which the errors of the last run first
+	// appeared, without their output, by errorKey.
+	first map[string]historyRun
+}
+
+// runHistory is the history, if it is kept.
+var runHistory *history
+
+// historyDir returns the directory of the history of the project in dir.
+func historyDir(dir string) string {
+	return filepath.Join(projectStateDir(dir), "history")
+}
+
+// newHistory returns a history for -history, or nil if it is off.
+func newHistory() (reporter, error) {
+	if *historySize <= 0 {
+		return nil, nil
+	}
+	dir, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+	h := &history{dir: historyDir(dir), first: make(map[string]historyRun)}
+	if err := os.MkdirAll(h.dir, 0755); err != nil {
+		return nil, fmt.Errorf("Failed to create the history directory: %s", err)
+	}
+	h.next = 1
+	for _, n := range historyRuns(h.dir) {
+		if hr, err := loadHistoryRun(h.dir, n); err == nil && hr.Rule == "" {
+			h.track(hr)
+		}
+		h.next = n + 1
+	}
+	runHistory = h
+	return h, nil
+}
+
+// track updates the runs in which errors first appeared with the next run.
+// An error that goes away and comes back appears anew.
+func (h *history) track(hr historyRun) {
+	hr.Stdout, hr.Stderr, hr.Capture = "", "", nil
+	first := make(map[string]historyRun)
+	for _, k := range hr.Errors {
+		if f, ok := h.first[k]; ok {
+			first[k] = f
+		} else {
+			first[k] = hr
+		}
+	}
+	h.first = first
+}
+
+// printBlame prints, for each error of the run, the run in which it
+// first appeared and the files changed for that run, like a blame for
+// the breakage.
+func (h *history) printBlame(out io.Writer, r runResult) {
+	keys := runErrors(r.diags)
+	if len(keys) == 0 {
+		return
+	}
+	tw := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ERROR\tFIRST\tCHANGED THEN")
+	for _, k := range keys {
+		f, ok := h.first[k]
+		if !ok {
+			continue
+		}
+		when := fmt.Sprintf("run %d, %s ago", f.N, time.Since(f.Start).Round(time.Second))
+		if f.N == h.next-1 {
+			when = "this run"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", k, when, strings.Join(f.Files, " "))
+	}
+	tw.Flush()
+}
+
+func (h *history) started(runResult) {}
+
+func (h *history) finished(r runResult) {
+	hr := historyRun{N: h.next, Args: r.args, Reason: r.reason, Start: r.start, End: r.end, Status: r.status,
+		Files: r.files(), Stdout: string(r.stdout), Stderr: string(r.stderr), Errors: runErrors(r.diags), Capture: r.capture, Rule: r.rule}
+	h.next++
+	// Rules' output is not scanned for errors, so their runs say nothing
+	// about when the command's errors appeared.
+	if r.rule == "" {
+		h.track(hr)
+	}
+	b, err := json.Marshal(hr)
+	if err == nil {
+		err = writeFileAtomic(filepath.Join(h.dir, strconv.Itoa(hr.N)+".json"), b)
+	}
+	if err != nil {
+		log.Printf("Failed to record run %d in the history: %s", hr.N, err)
+		return
+	}
+	ns := historyRuns(h.dir)
+	for len(ns) > *historySize {
+		os.Remove(filepath.Join(h.dir, strconv.Itoa(ns[0])+".json"))
+		ns = ns[1:]
+	}
+}
+
+// historyRuns returns the numbers of the runs kept in the history
+// directory, in order.
+func historyRuns(dir string) []int {
+	ents, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	var ns []int
+	for _, e := range ents {
+		if n, err := strconv.Atoi(strings.TrimSuffix(e.Name(), ".json")); err == nil && strings.HasSuffix(e.Name(), ".json") {
+			ns = append(ns, n)
+		}
+	}
+	sort.Ints(ns)
+	return ns
+}
+
+// loadHistoryRun returns run n from the history directory.
+func loadHistoryRun(dir string, n int) (historyRun, error) {
+	var hr historyRun
+	b, err := ioutil.ReadFile(filepath.Join(dir, strconv.Itoa(n)+".json"))
+	if os.IsNotExist(err) {
+		return hr, fmt.Errorf("Run %d is not in the history", n)
+	}
+	if err != nil {
+		return hr, err
+	}
+	return hr, json.Unmarshal(b, &hr)
+}
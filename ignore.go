@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	gitignore     = flag.Bool("gitignore", true, "Skip files and directories ignored by .gitignore files in the watched directories")
+	defaultIgnore = flag.Bool("default-ignore", true, "Skip version control directories, dependencies, caches and editor swap files: "+strings.Join(defaultIgnores, " "))
+)
+
+// defaultIgnores are the junk skipped with -default-ignore. Watching .git
+// alone would double the watches, and rerun the command on every git command.
+var defaultIgnores = []string{".git/", ".hg/", "node_modules/", "vendor/", "__pycache__/", "*.swp", "target/"}
+
+// defaultRules are the parsed defaultIgnores.
+var defaultRules []ignoreRule
+
+func init() {
+	for _, line := range defaultIgnores {
+		r, _ := parseIgnoreRule(line)
+		r.source = "-default-ignore " + line
+		defaultRules = append(defaultRules, r)
+	}
+}
+
+// An ignoreRule is a line of a gitignore-style file, matching
+// paths below the directory containing it.
+type ignoreRule struct {
+	re *regexp.Regexp
+	// anchored rules, those with a slash before their end, match the
+	// path relative to the directory; others match just the name.
+	anchored bool
+	dirOnly  bool
+	negate   bool
+	source   string // such as sub/.gitignore:3
+}
+
+// An ignoreFile is the rules loaded from a file, applying below its directory.
+type ignoreFile struct {
+	path, dir string
+	rules     []ignoreRule
+}
+
+// ignoreFiles are the loaded ignore files, by name, and ignoreOrder the
+// same sorted from the shallowest directory to the deepest, since rules
+// in deeper files take precedence. Once watching has started, both are
+// only used by sendChanges, and by the walkers it starts while holding
+// their locks.
+var (
+	ignoreFiles = make(map[string]ignoreFile)
+	ignoreOrder []ignoreFile
+)
+
+// watchIgnoreFile is the name of the file of shared ignore rules in a
+// watched directory, in the same syntax as .gitignore.
+const watchIgnoreFile = ".watchignore"
+
+// ignoreRoots are the directories given to watch, whose .watchignore
+// files are loaded. Once watching has started, it is only used by sendChanges.
+var ignoreRoots = make(map[string]bool)
+
+// isIgnoreFile reports whether p is a file of ignore rules to load.
+func isIgnoreFile(p string) bool {
+	switch filepath.Base(p) {
+	case ".gitignore":
+		return *gitignore
+	case watchIgnoreFile:
+		return ignoreRoots[filepath.Dir(p)]
+	}
+	return false
+}
+
+// loadIgnoreFile loads, reloads, or if it no longer exists, forgets
+// the rules in the file.
+func loadIgnoreFile(p string) {
+	f, err := os.Open(p)
+	if err != nil {
+		if _, ok := ignoreFiles[p]; ok {
+			debugPrint("Forgetting the rules in %s", p)
+			delete(ignoreFiles, p)
+			sortIgnoreFiles()
+		}
+		return
+	}
+	defer f.Close()
+
+	debugPrint("Loading the rules in %s", p)
+	inf := ignoreFile{path: p, dir: filepath.Dir(p)}
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		if r, ok := parseIgnoreRule(sc.Text()); ok {
+			r.source = p + ":" + strconv.Itoa(n)
+			inf.rules = append(inf.rules, r)
+		}
+	}
+	ignoreFiles[p] = inf
+	sortIgnoreFiles()
+}
+
+// sortIgnoreFiles updates ignoreOrder from ignoreFiles.
+func sortIgnoreFiles() {
+	ignoreOrder = ignoreOrder[:0]
+	for _, f := range ignoreFiles {
+		ignoreOrder = append(ignoreOrder, f)
+	}
+	sort.Slice(ignoreOrder, func(i, j int) bool {
+		a, b := ignoreOrder[i], ignoreOrder[j]
+		if depth(a.dir) != depth(b.dir) {
+			return depth(a.dir) < depth(b.dir)
+		}
+		return a.path < b.path
+	})
+}
+
+// depth returns the number of directories in p.
+func depth(p string) int {
+	if p == "." {
+		return 0
+	}
+	return strings.Count(p, string(filepath.Separator)) + 1
+}
+
+// parseIgnoreRule parses a line of a gitignore-style file, reporting
+// false for blank lines and comments.
+func parseIgnoreRule(line string) (ignoreRule, bool) {
+	line = strings.TrimRight(line, " \t\r")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return ignoreRule{}, false
+	}
+	var r ignoreRule
+	if strings.HasPrefix(line, "!") {
+		r.negate, line = true, line[1:]
+	}
+	line = strings.TrimPrefix(line, `\`)
+	if strings.HasSuffix(line, "/") {
+		r.dirOnly, line = true, strings.TrimRight(line, "/")
+	}
+	if strings.Contains(line, "/") {
+		r.anchored, line = true, strings.TrimPrefix(line, "/")
+	}
+	if line == "" {
+		return ignoreRule{}, false
+	}
+	re, err := regexp.Compile("^" + globRegexp(line) + "$")
+	if err != nil {
+		return ignoreRule{}, false
+	}
+	r.re = re
+	return r, true
+}
+
+// globRegexp translates a gitignore glob to a regular expression:
+// * and ? match within a name, and ** across names.
+func globRegexp(glob string) string {
+	var b strings.Builder
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; {
+		case strings.HasPrefix(glob[i:], "**/"):
+			b.WriteString("(.*/)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "/**") && i+3 == len(glob):
+			b.WriteString("(/.*)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "**"):
+			b.WriteString(".*")
+			i++
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?':
+			b.WriteString("[^/]")
+		case c == '[':
+			j := strings.IndexByte(glob[i:], ']')
+			if j < 0 {
+				b.WriteString(`\[`)
+				break
+			}
+			class := glob[i+1 : i+j]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + class + "]")
+			i += j
+		case c == '\\' && i+1 < len(glob):
+			i++
+			b.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return b.String()
+}
+
+// ignoredBy returns the rule that ignores p, such as sub/.gitignore:3, or ""
+// if none does. A path is ignored if its directory is, and otherwise
+// if the last rule matching it does not negate. The default rules come
+// first, so that ignore files can override them.
+func ignoredBy(p string, isDir bool) string {
+	if (len(ignoreOrder) == 0 && !*defaultIgnore) || p == "." {
+		return ""
+	}
+	if dir := filepath.Dir(p); dir != "." && dir != p {
+		if why := ignoredBy(dir, true); why != "" {
+			return why
+		}
+	}
+	var why string
+	if *defaultIgnore {
+		why = matchRules(defaultRules, filepath.Base(p), isDir, why)
+	}
+	for _, f := range ignoreOrder {
+		if p == f.dir || !within(p, f.dir) {
+			continue
+		}
+		rel := p
+		if f.dir != "." {
+			rel = p[len(f.dir)+1:]
+		}
+		why = matchRules(f.rules, rel, isDir, why)
+	}
+	return why
+}
+
+// matchRules applies the rules to rel, a path relative to their
+// directory, returning the rule that last ignored it, if any, or else why.
+func matchRules(rules []ignoreRule, rel string, isDir bool, why string) string {
+	for _, r := range rules {
+		if r.dirOnly && !isDir {
+			continue
+		}
+		name := rel
+		if !r.anchored {
+			name = filepath.Base(rel)
+		}
+		if r.re.MatchString(filepath.ToSlash(name)) {
+			why = r.source
+			if r.negate {
+				why = ""
+			}
+		}
+	}
+	return why
+}
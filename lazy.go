@@ -0,0 +1,21 @@
+package main
+
+import (
+	"flag"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+var lazyDepth = flag.Int("lazy", 0, "Watch only this many levels of directories below each watched directory at first, and those below a directory once there is activity in it, to use fewer watches on huge trees (default: all)")
+
+// lazyDirs are the watched directories with directories below them that
+// are not watched yet. It is only used by sendChanges.
+var lazyDirs = make(map[string]bool)
+
+// deepen watches the directories below dir, a lazily watched directory
+// in which there was activity, to -lazy levels below it.
+func deepen(w *fsnotify.Watcher, dir string) {
+	debugPrint("Activity in %s, watching below it", dir)
+	delete(lazyDirs, dir)
+	watchDir(w, dir)
+}
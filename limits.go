@@ -0,0 +1,90 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"time"
+)
+
+var (
+	untilSuccess = flag.Bool("until-success", false, "Exit as soon as the command succeeds")
+	maxRuns      = flag.Int("max-runs", 0, "Exit after running the command this many times, with the status of the last run")
+	idleExit     = flag.Duration("idle-exit", 0, "Exit after this long without changes or runs")
+)
+
+// runCount and failCount are the numbers of runs and failed runs so
+// far, and commandTime the time spent running the command.
+var (
+	runCount, failCount int
+	commandTime         time.Duration
+)
+
+// sessionStart is when Watch started.
+var sessionStart = time.Now()
+
+// printSessionSummary sums up the session on exit.
+func printSessionSummary() {
+	if upgrading {
+		return
+	}
+	log.Printf("Session summary: runs %d, failed %d, %s running the command, %s watching",
+		runCount, failCount, commandTime.Round(time.Millisecond), time.Since(sessionStart).Round(time.Second))
+}
+
+// countRun adds the run to the session's totals.
+func countRun(r runResult) {
+	runCount++
+	commandTime += r.end.Sub(r.start)
+	if r.status != 0 {
+		failCount++
+	}
+}
+
+// afterRun exits once a run has finished the job Watch was started for.
+func afterRun(r runResult) {
+	countRun(r)
+	if *untilSuccess && r.status == 0 {
+		log.Println("Command succeeded, exiting")
+		exit(0)
+	}
+	if *maxRuns > 0 && runCount >= *maxRuns {
+		log.Printf("Ran %d times, exiting", runCount)
+		if r.status != 0 {
+			exit(1)
+		}
+		exit(0)
+	}
+}
+
+// newIdleTimer returns a timer for -idle-exit, which never fires if
+// it is not set.
+func newIdleTimer() *time.Timer {
+	t := time.NewTimer(*idleExit)
+	if *idleExit <= 0 {
+		t.Stop()
+	}
+	return t
+}
+
+// resetIdle restarts the idle timer after activity.
+func resetIdle(t *time.Timer) {
+	if *idleExit > 0 {
+		t.Reset(*idleExit)
+	}
+}
+
+// stopIdle stops the idle timer while the command runs, dropping a
+// firing not yet received.
+func stopIdle(t *time.Timer) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+}
+
+// idle reports that Watch is exiting after -idle-exit without activity.
+func idle() {
+	log.Printf("Idle for %s, exiting", *idleExit)
+}
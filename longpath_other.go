@@ -0,0 +1,10 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+// longPath and shortPath convert between the usual and extended-length
+// forms of Windows paths. Other systems have only one form.
+func longPath(p string) string { return p }
+
+func shortPath(p string) string { return p }
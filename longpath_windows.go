@@ -0,0 +1,52 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// Windows paths longer than MAX_PATH, and UNC paths on network drives,
+// must be passed to the Windows API in their extended-length forms,
+// \\?\C:\dir and \\?\UNC\server\share\dir. Watch works with the usual
+// forms everywhere else, so that exclude patterns and the names shown
+// to the user do not depend on the length of a path.
+const (
+	longPrefix    = `\\?\`
+	longUNCPrefix = `\\?\UNC\`
+)
+
+// longPath returns the extended-length form of p, for registering
+// watches and reading directories.
+func longPath(p string) string {
+	if strings.HasPrefix(p, longPrefix) {
+		return p
+	}
+	a, err := filepath.Abs(p)
+	if err != nil {
+		return p
+	}
+	if strings.HasPrefix(a, `\\`) {
+		return longUNCPrefix + a[2:]
+	}
+	return longPrefix + a
+}
+
+// shortPath returns the usual form of the extended-length path p,
+// such as an event name for a watch registered with longPath.
+// If p is relative to the working directory, so is the result.
+func shortPath(p string) string {
+	switch {
+	case strings.HasPrefix(p, longUNCPrefix):
+		p = `\\` + p[len(longUNCPrefix):]
+	case strings.HasPrefix(p, longPrefix):
+		p = p[len(longPrefix):]
+	default:
+		return p
+	}
+	if wd, err := filepath.Abs("."); err == nil {
+		if rel, err := filepath.Rel(wd, p); err == nil && !strings.HasPrefix(rel, "..") {
+			return rel
+		}
+	}
+	return p
+}
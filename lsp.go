@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var lspMode = flag.Bool("lsp", false, "Speak the Language Server Protocol on stdin and stdout, publishing diagnostics from each run; command output goes to stderr")
+
+// An lspServer implements the small subset of the Language Server
+// Protocol needed to publish diagnostics from each run to an editor.
+type lspServer struct {
+	mu  sync.Mutex
+	out io.Writer
+	// published holds the URIs of the files with published diagnostics,
+	// so that they can be cleared when a later run no longer reports them.
+	published map[string]bool
+}
+
+type lspMessage struct {
+	JSONRPC string           `json:"jsonrpc"`
+	ID      *json.RawMessage `json:"id,omitempty"`
+	Method  string           `json:"method,omitempty"`
+	Params  interface{}      `json:"params,omitempty"`
+	Result  interface{}      `json:"result,omitempty"`
+	Error   *lspError        `json:"error,omitempty"`
+}
+
+type lspError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type lspPosition struct {
+	Line      int `json:"line"`
+	Character int `json:"character"`
+}
+
+type lspDiagnostic struct {
+	Range struct {
+		Start lspPosition `json:"start"`
+		End   lspPosition `json:"end"`
+	} `json:"range"`
+	Severity int    `json:"severity"`
+	Source   string `json:"source"`
+	Message  string `json:"message"`
+}
+
+// newLSPServer returns an lspServer for the -lsp flag,
+// or nil if LSP mode is disabled.
+func newLSPServer() (reporter, error) {
+	if !*lspMode {
+		return nil, nil
+	}
+	s := &lspServer{out: os.Stdout, published: make(map[string]bool)}
+	go s.serve(os.Stdin)
+	return s, nil
+}
+
+// serve reads and answers requests from the editor.
+func (s *lspServer) serve(in io.Reader) {
+	r := bufio.NewReader(in)
+	for {
+		var msg lspMessage
+		switch err := readLSPMessage(r, &msg); {
+		case err == io.EOF:
+			debugPrint("LSP client closed its connection")
+			exit(0)
+		case err != nil:
+			log.Printf("Bad LSP message: %s", err)
+			continue
+		}
+
+		switch {
+		case msg.Method == "exit":
+			exit(0)
+		case msg.ID == nil:
+			// Notifications, such as initialized and didSave, need no reply.
+		case msg.Method == "initialize":
+			s.send(lspMessage{ID: msg.ID, Result: map[string]interface{}{
+				"capabilities": map[string]interface{}{},
+				"serverInfo":   map[string]string{"name": "Watch"},
+			}})
+		case msg.Method == "shutdown":
+			s.send(lspMessage{ID: msg.ID, Result: json.RawMessage("null")})
+		default:
+			s.send(lspMessage{ID: msg.ID, Error: &lspError{Code: -32601, Message: "method not found: " + msg.Method}})
+		}
+	}
+}
+
+// readLSPMessage reads a message framed by a Content-Length header.
+func readLSPMessage(r *bufio.Reader, msg *lspMessage) error {
+	n := -1
+	for {
+		l, err := r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		l = strings.TrimSpace(l)
+		if l == "" {
+			break
+		}
+		if i := strings.IndexByte(l, ':'); i > 0 && strings.EqualFold(l[:i], "Content-Length") {
+			if n, err = strconv.Atoi(strings.TrimSpace(l[i+1:])); err != nil {
+				return err
+			}
+		}
+	}
+	if n < 0 {
+		return fmt.Errorf("missing Content-Length")
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return err
+	}
+	return json.Unmarshal(b, msg)
+}
+
+func (s *lspServer) send(msg lspMessage) {
+	msg.JSONRPC = "2.0"
+	b, err := json.Marshal(msg)
+	if err != nil {
+		log.Printf("Failed to encode LSP message: %s", err)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fmt.Fprintf(s.out, "Content-Length: %d\r\n\r\n%s", len(b), b)
+}
+
+func (s *lspServer) started(runResult) {}
+
+// finished publishes the run's diagnostics, grouped by file,
+// and clears the diagnostics of files that no longer have any.
+// Rules' runs have no diagnostics, and leave the command's be.
+func (s *lspServer) finished(r runResult) {
+	if r.rule != "" {
+		return
+	}
+	files := make(map[string][]lspDiagnostic)
+	for _, d := range r.diags {
+		u := fileURI(d.File)
+		var ld lspDiagnostic
+		ld.Range.Start = lspPosition{Line: d.Line - 1}
+		if d.Col > 0 {
+			ld.Range.Start.Character = d.Col - 1
+		}
+		ld.Range.End = ld.Range.Start
+		ld.Severity = 1
+		if d.warning() {
+			ld.Severity = 2
+		}
+		ld.Source = "Watch"
+		ld.Message = d.Message
+		files[u] = append(files[u], ld)
+	}
+	for u := range s.published {
+		if _, ok := files[u]; !ok {
+			files[u] = []lspDiagnostic{}
+		}
+	}
+	s.published = make(map[string]bool)
+	for u, ds := range files {
+		if len(ds) > 0 {
+			s.published[u] = true
+		}
+		s.send(lspMessage{Method: "textDocument/publishDiagnostics", Params: map[string]interface{}{
+			"uri":         u,
+			"diagnostics": ds,
+		}})
+	}
+}
+
+// fileURI returns the file URI of p, relative to the working directory.
+func fileURI(p string) string {
+	return (&url.URL{Scheme: "file", Path: filepath.ToSlash(absPath(p))}).String()
+}
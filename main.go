@@ -1,19 +1,22 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
-	"path"
+	"os/signal"
+	"path/filepath"
 	"reflect"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -21,15 +24,85 @@ import (
 )
 
 var (
-	debug     = flag.Bool("v", false, "Enable verbose debugging output")
-	term      = flag.Bool("t", true, "Run in a terminal (deprecated, always true)")
-	exclude   = flag.String("x", "", "Exclude files and directories matching this regular expression")
-	watchPath = flag.String("p", ".", "The path to watch")
+	debug = flag.Bool("v", false, "Enable verbose debugging output")
+	term  = flag.Bool("t", true, "Run in a terminal (deprecated, always true)")
 )
 
-var excludeRe *regexp.Regexp
+// watchPaths are the files and directories to watch, given with -p,
+// and excludes the regular expressions given with -x.
+var watchPaths, excludes stringList
 
-const rebuildDelay = 200 * time.Millisecond
+func init() {
+	flag.Var(&watchPaths, "p", "A path to watch; may be repeated (default .)")
+	flag.Var(&excludes, "x", "Exclude files and directories matching this regular expression; may be repeated")
+}
+
+// A stringList is a flag.Value that collects the values of a repeated flag.
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ",") }
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+// A change is a single file system event that may trigger a rerun.
+type change struct {
+	time time.Time
+	path string
+	op   fsnotify.Op
+}
+
+// filtersMu guards the compiled -x patterns and -g globs, and -d, which
+// change on reloading the configuration.
+var filtersMu sync.RWMutex
+
+// defaultDelay returns -d.
+func defaultDelay() time.Duration {
+	filtersMu.RLock()
+	defer filtersMu.RUnlock()
+	return *rebuildDelay
+}
+
+var excludeRes []*regexp.Regexp
+
+// setupExcludes compiles the -x patterns.
+func setupExcludes() error {
+	var res []*regexp.Regexp
+	for _, x := range excludes {
+		re, err := regexp.Compile(normName(x))
+		if err != nil {
+			return fmt.Errorf("Bad regexp: %s", x)
+		}
+		res = append(res, re)
+	}
+	filtersMu.Lock()
+	excludeRes = res
+	filtersMu.Unlock()
+	return nil
+}
+
+// excludedBy returns the -x pattern or -g glob that excludes p, if any,
+// such as "-x vendor/".
+func excludedBy(p string) string {
+	filtersMu.RLock()
+	defer filtersMu.RUnlock()
+	for _, re := range excludeRes {
+		if re.MatchString(p) {
+			return "-x " + re.String()
+		}
+	}
+	if g := globExcludedBy(p); g != "" {
+		return "-g " + g
+	}
+	return ""
+}
+
+// cmdArgs are the command to run and its arguments.
+var cmdArgs []string
+
+var rebuildDelay = flag.Duration("d", 200*time.Millisecond, "How long to wait for more changes before running the command")
 
 // The name of the syscall.SysProcAttr.Setpgid field.
 const setpgidName = "Setpgid"
@@ -37,26 +110,46 @@ const setpgidName = "Setpgid"
 var (
 	hasSetPGID bool
 	killChan   = make(chan time.Time, 1)
+	// child is the setup of the command's process, if it needs any.
+	child *childConfig
 )
 
-type ui interface {
-	redisplay(func(io.Writer))
-	// An empty struct is sent when the command should be rerun.
-	rerun() <-chan struct{}
+// subcommands are run instead of watching when named by the first argument.
+// A command with the same name can still be watched by preceding it with --.
+var subcommands = map[string]func(args []string){
+	"status":   statusCmd,
+	"ctl":      ctlCmd,
+	"upgrade":  upgradeCmd,
+	"bench":    benchCmd,
+	"diff":     diffCmd,
+	"attach":   attachCmd,
+	"replay":   replayCmd,
+	"simulate": simulateCmd,
+	"check":    checkCmd,
 }
 
-type writerUI struct{ io.Writer }
-
-func (w writerUI) redisplay(f func(io.Writer)) { f(w) }
+func main() {
+	if cfg := os.Getenv(childEnv); cfg != "" {
+		childMain(cfg)
+	}
 
-func (w writerUI) rerun() <-chan struct{} { return nil }
+	if len(os.Args) > 1 {
+		if sub, ok := subcommands[os.Args[1]]; ok {
+			sub(os.Args[2:])
+			return
+		}
+	}
 
-func main() {
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage of %s: [flags] command [command args…]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s status [-tmux] [dir]\n", os.Args[0])
 		flag.PrintDefaults()
 	}
 	flag.Parse()
+	command, err := loadConfig()
+	if err != nil {
+		log.Fatalln(err)
+	}
 
 	t := reflect.TypeOf(syscall.SysProcAttr{})
 	f, ok := t.FieldByName(setpgidName)
@@ -69,90 +162,876 @@ func main() {
 		debugPrint("syscall.SysProcAttr.Setpgid does not exist")
 	}
 
-	if flag.NArg() == 0 {
+	cmdArgs = flag.Args()
+	if len(cmdArgs) == 0 {
+		cmdArgs = command
+	}
+	if len(cmdArgs) == 0 && *benchMode {
+		cmdArgs = defaultBenchArgs()
+	}
+	if len(cmdArgs) == 0 && len(rules) == 0 {
 		flag.Usage()
 		os.Exit(1)
 	}
+	if err := checkRace(cmdArgs); err != nil {
+		log.Fatalln(err)
+	}
 
-	ui := ui(writerUI{os.Stdout})
+	ui, err := newUI()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if ui, err = startShare(ui); err != nil {
+		log.Fatalln(err)
+	}
+	if ui, err = startRecording(ui); err != nil {
+		log.Fatalln(err)
+	}
 
-	if *exclude != "" {
-		var err error
-		excludeRe, err = regexp.Compile(*exclude)
+	// The first signal cancels ctx, to stop the command and watcher and
+	// flush the output before exiting; a second exits at once.
+	ctx, cancel := context.WithCancel(context.Background())
+	resumeSession()
+	atExit(printSessionSummary)
+	atExit(cancel)
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		s := <-sigs
+		debugPrint("Stopping on %s", s)
+		cancel()
+		s = <-sigs
+		debugPrint("Exiting on %s", s)
+		exit(1)
+	}()
+
+	// In a Go workspace, run from its root and watch all of its modules.
+	var roots, globs []string
+	for _, p := range watchPaths {
+		if isGlob(os.ExpandEnv(p)) {
+			globs = append(globs, p)
+		}
+		m, err := expandRoot(p)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if len(m) == 0 {
+			log.Printf("%s matches nothing", p)
+		}
+		roots = append(roots, m...)
+	}
+	switch {
+	case len(watchPaths) == 0:
+		roots = []string{"."}
+	case len(roots) == 0:
+		log.Fatalln("Nothing to watch")
+	}
+	if work := findGoWork("."); *goMode && work != "" {
+		members, err := goWorkMembers(work)
+		if err != nil {
+			log.Fatalf("Failed to read %s: %s", work, err)
+		}
+		if err := os.Chdir(filepath.Dir(work)); err != nil {
+			log.Fatalln(err)
+		}
+		debugPrint("Watching the workspace %s", work)
+		roots = append(members, filepath.Base(work))
+		if len(excludes) == 0 {
+			excludes = stringList{goWorkExclude}
+		}
+	}
+
+	if err := setupExcludes(); err != nil {
+		log.Fatalln(err)
+	}
+
+	if err := setupColor(); err != nil {
+		log.Fatalln(err)
+	}
+	if err := setupFilters(); err != nil {
+		log.Fatalln(err)
+	}
+	if err := setupDebounce(); err != nil {
+		log.Fatalln(err)
+	}
+	if err := checkGenFlags(); err != nil {
+		log.Fatalln(err)
+	}
+	if err := checkMigrateFlags(); err != nil {
+		log.Fatalln(err)
+	}
+	if err := checkTemplateFlags(); err != nil {
+		log.Fatalln(err)
+	}
+	if *fifoPath != "" {
+		if err := setupFIFO(*fifoPath); err != nil {
+			log.Fatalln(err)
+		}
+		addOwnFile(*fifoPath)
+	}
+	if err := loadAllowList(); err != nil {
+		log.Fatalln(err)
+	}
+	if len(cmdArgs) > 0 {
+		if err := checkAllowed(cmdArgs[0]); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	for _, r := range rules {
+		if err := checkAllowed(r.args[0]); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if err := setupProbes(); err != nil {
+		log.Fatalln(err)
+	}
+
+	if child, err = childSetup(); err != nil {
+		log.Fatalln(err)
+	}
+
+	if *restart {
+		replaceOrphan()
+	}
+
+	for _, newReporter := range []func() (reporter, error){
+		newNotifier,
+		newStatusFile,
+		newGithubReporter,
+		newSessionStatus,
+		newLSPServer,
+		newNvimReporter,
+		newCtlServer,
+		newAuditLog,
+		newPlugins,
+		newAssetPipeline,
+		newHistory,
+	} {
+		rep, err := newReporter()
 		if err != nil {
-			log.Fatalln("Bad regexp: ", *exclude)
+			log.Fatalln(err)
+		}
+		if rep != nil {
+			reporters = append(reporters, rep)
 		}
 	}
 
 	timer := time.NewTimer(0)
-	changes := startWatching(*watchPath)
+	changes := startWatching(ctx, roots)
+	stopRules := startRules(ctx, ui)
+	atExit(func() { stopRules() })
+	hups := make(chan os.Signal, 1)
+	signal.Notify(hups, syscall.SIGHUP)
+	notifyPause()
+	notifyTrigger()
+	if len(globs) > 0 && *globRescan > 0 {
+		go watchNewMatches(globs, roots)
+	}
+	if *fifoPath != "" {
+		go readFIFO(*fifoPath, changes)
+	}
+	if *goMode && len(roots) == 1 {
+		// The watcher serves the requests between sending changes, which
+		// are not read until the loop below, so it must not wait for it.
+		go watchGoModule(roots[0])
+	}
 	lastRun := time.Time{}
 	lastChange := time.Now()
+	var pending []change
+	var settling settler
+	idleTimer := newIdleTimer()
+
+	var lines chan string
+	if *triggerStdin {
+		lines = make(chan string)
+		go readStdin(lines)
+	}
+
+	streams := streamer{ui: ui}
+	if *streamPaths {
+		atExit(streams.stop)
+	}
+
+	// Runs happen in the background, so that they can be restarted, and
+	// changes are collected meanwhile. Only one runs at a time: a run
+	// requested during another waits for it, or with -r stops it. Changes
+	// made during a run call for another once it ends, unless the command
+	// made them itself.
+	var (
+		running bool
+		again   string // the reason for the run to start when the current one ends
+		// queuedLines are the -trigger-stdin lines read during a run,
+		// each to run for in turn once it ends.
+		queuedLines []string
+		// While the run is being confirmed, the loop goes on, and the
+		// answer comes on confirms. confirmed lets the run start then.
+		confirming, confirmed bool
+		confirms              = make(chan confirmation)
+		follow                followUps
+		// jobs are the results of the steps run for the current run.
+		jobs  []jobResult
+		done  = make(chan runResult)
+		grace = time.NewTimer(0)
+		// current, debounce, and due are shown in the queue state.
+		current  *queueRun
+		debounce string
+		due      time.Time
+		// While paused, changes are queued, and those for rules held,
+		// but run nothing until resumed.
+		paused bool
+		held   []change
+	)
+	grace.Stop()
+	showQueue := func() {
+		q := queueState{Running: current, Queued: (runResult{changes: pending}).files(), Next: again, Debounce: "idle"}
+		if len(pending) > 0 {
+			q.Debounce = debounce
+			if !due.IsZero() {
+				q.Due = &due
+			}
+		}
+		if paused {
+			q.Debounce, q.Due = "paused", nil
+		}
+		setQueue(q)
+	}
+	if *restart || *killStale {
+		atExit(stopRunning)
+	}
+	// stop stops the current run, to start the next one when it has.
+	stop := func(reason string) {
+		again = reason
+		kill()
+		grace.Reset(*restartWait)
+	}
+
+	// handleChange routes a change to its rule, or queues it for a run.
+	handleChange := func(c change) {
+		if sessionRecorder != nil {
+			sessionRecorder.event(c)
+		}
+		if r := ruleFor(c.path); r != nil {
+			if paused {
+				explain(c.path, c.op, "queued", "for -rule %s once resumed", r.label)
+				held = append(held, c)
+				return
+			}
+			explain(c.path, c.op, "queued", "for -rule %s", r.label)
+			r.changes <- c
+			if !running {
+				resetIdle(idleTimer)
+			}
+			return
+		}
+		lastChange = c.time
+		if !running {
+			follow.changed(c.path)
+		}
+		if (runResult{changes: pending}).has(c.path) {
+			explain(c.path, c.op, "deduplicated", "already pending")
+		}
+		pending = append(pending, c)
+		if paused {
+			explain(c.path, c.op, "queued", "running once resumed")
+			return
+		}
+		d := debounceDelay(pending)
+		explain(c.path, c.op, "queued", "running in %s unless more changes come", d)
+		debounce, due = "debouncing", time.Now().Add(d)
+		timer.Reset(d)
+		if *killStale && running && again == "" {
+			debugPrint("Killing the run for older changes")
+			stop("change")
+		}
+		if !running {
+			resetIdle(idleTimer)
+		}
+	}
+
+	// shutdown stops the command, waiting for the rest of its output,
+	// and exits.
+	shutdown := func(code int) {
+		cancel()
+		if running {
+			countRun(<-done)
+		}
+		exit(code)
+	}
+
+	var start func(reason, line string)
+	start = func(reason, line string) {
+		// Steps and runs are not idleness, however long they take.
+		stopIdle(idleTimer)
+		defer func() {
+			if !running {
+				resetIdle(idleTimer)
+			}
+		}()
+		if len(cmdArgs) == 0 {
+			// Only rules run.
+			lastRun, pending = time.Now(), nil
+			return
+		}
+		if running {
+			if reason == "stdin" {
+				queuedLines = append(queuedLines, line)
+			}
+			switch {
+			case *restart || *killStale:
+				debugPrint("Restarting")
+				stop(reason)
+			case reason != "change" && reason != "stdin":
+				again = reason
+			}
+			return
+		}
+		if *streamPaths {
+			explainAll(pending, "streamed", "written to the command's input")
+			streams.send(pending)
+			lastRun, pending = time.Now(), nil
+			return
+		}
+		if *confirmRuns && !confirmed {
+			if !confirming {
+				confirming = true
+				asked := pending
+				go func() { confirms <- confirmation{reason, line, asked, confirm("", asked)} }()
+			} else if reason == "stdin" {
+				queuedLines = append(queuedLines, line)
+			}
+			return
+		}
+		confirmed = false
+		// job runs one of the steps before the command, reporting whether it succeeded.
+		jobs = nil
+		job := func(name string, f func(io.Writer) bool) bool {
+			t, ok := time.Now(), false
+			ui.redisplay(func(out io.Writer) {
+				mw := jobOutput(out, name)
+				ok = f(mw)
+				mw.Flush()
+			})
+			status := "ok"
+			if !ok {
+				status = "failed"
+			}
+			jobs = append(jobs, jobResult{name, status, time.Since(t)})
+			if !ok {
+				ui.redisplay(func(out io.Writer) { printSummary(out, jobs) })
+				lastRun, pending = time.Now(), nil
+			}
+			return ok
+		}
+		if runs, ok := fastRuns(pending); reason == "change" && ok {
+			for _, r := range runs {
+				r := r
+				if !job(filepath.Base(r.rule.args[0]), func(out io.Writer) bool { return runFast(ctx, out, r) }) {
+					return
+				}
+			}
+			explainAll(pending, "ran", "matches -fast rules")
+			ui.redisplay(func(out io.Writer) { printSummary(out, jobs) })
+			lastRun, pending = time.Now(), nil
+			return
+		}
+		if needsMigrate(reason, pending) && !job("migrate", func(out io.Writer) bool { return applyMigrations(ctx, out) }) {
+			return
+		}
+		if needsRender(reason, pending) && !job("render", renderTemplates) {
+			return
+		}
+		if targets, only := fuzzTargets(pending); *fuzzMode && len(targets) > 0 {
+			if !job("fuzz", func(out io.Writer) bool { return runFuzzSeeds(ctx, out, targets) }) {
+				return
+			}
+			if only {
+				explainAll(pending, "ran", "the seed corpus of its fuzz test")
+				ui.redisplay(func(out io.Writer) { printSummary(out, jobs) })
+				lastRun, pending = time.Now(), nil
+				return
+			}
+		}
+		// others are the changes made while generating that are not its
+		// output, handled as usual once the run has started.
+		var others []change
+		if needsGen(reason, pending) {
+			if !job("gen", func(out io.Writer) bool { return runGen(ctx, out) }) {
+				return
+			}
+			var generated []change
+			generated, others = collectGenerated(changes, isGenInput)
+			recordAll(generated)
+			explainAll(generated, "queued", "written by -gen")
+			pending = append(pending, generated...)
+		}
+		if pkgs := generatePackages(pending); len(pkgs) > 0 {
+			if !job("generate", func(out io.Writer) bool { return runGoGenerate(ctx, out, pkgs) }) {
+				return
+			}
+			generated, more := collectGenerated(changes, isGenerateInput)
+			recordAll(generated)
+			explainAll(generated, "queued", "written by go generate")
+			pending = append(pending, generated...)
+			others = append(others, more...)
+		}
+		explainAll(pending, "ran", "run #%d", runCount+1)
+		running, lastRun = true, time.Now()
+		current = &queueRun{Reason: reason, Start: lastRun, Files: (runResult{changes: pending}).files()}
+		go func(changes []change) { done <- run(ctx, ui, reason, changes, line) }(pending)
+		pending = nil
+		for _, c := range others {
+			handleChange(c)
+		}
+	}
+
+	if adopted != nil {
+		// Go on waiting for the command run by the binary this was
+		// before upgrading, rather than start it.
+		running, lastRun, lastChange = true, adopted.Start, adopted.Start
+		current = &queueRun{Reason: adopted.Reason, Start: adopted.Start}
+		stopIdle(idleTimer)
+		go func(h *handedOffRun) { done <- adoptRun(ctx, ui, h) }(adopted)
+	}
 
 	for {
 		select {
-		case lastChange = <-changes:
-			timer.Reset(rebuildDelay)
+		case c := <-changes:
+			handleChange(c)
 
 		case <-ui.rerun():
-			lastRun = run(ui)
+			start("trigger", "")
+
+		case <-hups:
+			changed, err := reloadConfig()
+			if err != nil {
+				log.Printf("Failed to reload %s: %s", configFile, err)
+				break
+			}
+			if changed["rule"] {
+				stopRules()
+				stopRules = startRules(ctx, ui)
+			}
+
+		case <-triggers:
+			start("trigger", "")
+
+		case req := <-pauses:
+			if req == "toggle" {
+				req = "pause"
+				if paused {
+					req = "resume"
+				}
+			}
+			switch {
+			case req == "pause" && !paused:
+				paused = true
+				log.Printf("Paused: changes are queued, but run nothing until resumed")
+			case req == "resume" && paused:
+				paused = false
+				for _, c := range held {
+					if r := ruleFor(c.path); r != nil {
+						r.changes <- c
+					}
+				}
+				n := len((runResult{changes: pending}).files()) + len((runResult{changes: held}).files())
+				log.Printf("Resumed with %d changed files", n)
+				held = nil
+				if len(pending) > 0 {
+					// Run once for all of them.
+					timer.Reset(0)
+				}
+				if !running {
+					resetIdle(idleTimer)
+				}
+			}
+
+		case line := <-lines:
+			start("stdin", line)
+
+		case r := <-done:
+			running, current = false, nil
+			grace.Stop()
+			lastRun = r.end
+			jobs = append(jobs, commandJob(r))
+			ui.redisplay(func(out io.Writer) { printSummary(out, jobs) })
+			if *benchMode {
+				ui.redisplay(func(out io.Writer) { compareBench(out, r) })
+			}
+			if runHistory != nil {
+				ui.redisplay(func(out io.Writer) { runHistory.printBlame(out, r) })
+			}
+			afterRun(r)
+			resetIdle(idleTimer)
+			if len(queuedLines) > 0 {
+				line := queuedLines[0]
+				queuedLines = queuedLines[1:]
+				if again == "stdin" {
+					again = ""
+				}
+				start("stdin", line)
+			} else if reason := again; reason != "" {
+				again = ""
+				start(reason, "")
+			} else if len(pending) > 0 {
+				var own []change
+				pending, own = follow.filter(pending)
+				explainAll(own, "ignored", "taken to be written by the command, since it changed during the last run too")
+				if len(pending) > 0 {
+					// Run again once the changes have settled, if they
+					// have not already.
+					lastRun = r.start
+					if !due.After(time.Now()) {
+						timer.Reset(0)
+					}
+				}
+			} else {
+				follow.last = nil
+			}
+
+		case a := <-confirms:
+			confirming = false
+			if a.ok {
+				confirmed = true
+				start(a.reason, a.line)
+				break
+			}
+			explainAll(a.changes, "declined", "the run was not confirmed")
+			// Changes made during the prompt are asked about in turn.
+			lastRun, pending = time.Now(), pending[len(a.changes):]
+			if len(pending) > 0 {
+				timer.Reset(0)
+			} else if len(queuedLines) > 0 {
+				line := queuedLines[0]
+				queuedLines = queuedLines[1:]
+				start("stdin", line)
+			}
+			if !running {
+				resetIdle(idleTimer)
+			}
+
+		case <-grace.C:
+			if running {
+				kill()
+			}
+
+		case <-ruleRan:
+			if !running {
+				resetIdle(idleTimer)
+			}
+
+		case <-idleTimer.C:
+			if running || atomic.LoadInt32(&rulesRunning) > 0 {
+				// Reset when the run ends.
+				break
+			}
+			idle()
+			shutdown(0)
+
+		case <-ctx.Done():
+			shutdown(1)
+
+		case <-upgrades:
+			if running {
+				// Hand the command over to the upgraded binary, rather
+				// than stop it, unless it is just exiting.
+				close(handOff)
+				if r := <-done; handedOff == nil {
+					countRun(r)
+				}
+			}
+			cancel()
+			if err := reexec(); err != nil {
+				log.Fatalf("Failed to upgrade: %s", err)
+			}
 
 		case <-timer.C:
-			if lastRun.Before(lastChange) {
-				lastRun = run(ui)
+			switch {
+			case lastRun.IsZero() && *appear != "":
+				debugPrint("waiting for %s to appear", *appear)
+				lastRun = time.Now()
+			case lastRun.IsZero():
+				start("start", "")
+			case paused:
+			case lastRun.Before(lastChange):
+				if *settleTime > 0 && !settling.settled(pending) {
+					debugPrint("waiting for changed files to settle")
+					explainAll(pending, "waiting", "files have not settled for %s", *settleTime)
+					debounce, due = "settling", time.Now().Add(*settleTime)
+					timer.Reset(*settleTime)
+					break
+				}
+				debounce, due = "waiting for the running command", time.Time{}
+				start("change", "")
 			}
 		}
+		showQueue()
+	}
+}
+
+// A reporter is told when each run starts and finishes. When a run
+// starts, its result has just its arguments, reason, changes, and start time.
+// Constructors of optional reporters return nil when they are disabled.
+type reporter interface {
+	started(r runResult)
+	finished(r runResult)
+}
+
+var reporters []reporter
+
+// reportMu serializes the calls to the reporters, since rules run their
+// commands alongside the command's.
+var reportMu sync.Mutex
+
+// reportStarted tells the reporters that the run started.
+func reportStarted(r runResult) {
+	reportMu.Lock()
+	defer reportMu.Unlock()
+	for _, rep := range reporters {
+		rep.started(r)
+	}
+}
+
+// reportFinished tells the reporters that the run finished.
+func reportFinished(r runResult) {
+	reportMu.Lock()
+	defer reportMu.Unlock()
+	for _, rep := range reporters {
+		rep.finished(r)
+	}
+}
+
+// An alerter is a reporter that can also be sent messages other than
+// run results, such as benchmark regressions.
+type alerter interface {
+	alert(msg string)
+}
+
+// alert sends msg to the reporters that take alerts.
+func alert(msg string) {
+	for _, rep := range reporters {
+		if a, ok := rep.(alerter); ok {
+			a.alert(msg)
+		}
+	}
+}
+
+// A runResult describes a single execution of the command.
+type runResult struct {
+	args []string
+	// reason is why the command ran: start, change, trigger, or stdin.
+	reason string
+	// line is the line of standard input that triggered the run, with -trigger-stdin.
+	line       string
+	start, end time.Time
+	// status is the exit status of the command, or -1 if it failed to start.
+	status int
+	// firstErr is the first line of output that looks like an error.
+	firstErr string
+	diags    []diagnostic
+	changes  []change
+	// stdout and stderr are the command's output, up to maxCapture bytes of each.
+	stdout, stderr []byte
+	// capture is the state of the toolchain and environment, with -capture.
+	capture *runCapture
+	// rule is the label of the -rule whose command ran, if not the command.
+	rule string
+}
+
+// has reports whether the path is one of the changed files.
+func (r runResult) has(path string) bool {
+	for _, c := range r.changes {
+		if c.path == path {
+			return true
+		}
 	}
+	return false
 }
 
-func run(ui ui) time.Time {
+// files returns the paths of the changed files, without duplicates.
+func (r runResult) files() []string {
+	var fs []string
+	seen := make(map[string]bool)
+	for _, c := range r.changes {
+		if !seen[c.path] {
+			seen[c.path] = true
+			fs = append(fs, c.path)
+		}
+	}
+	return fs
+}
+
+// run runs the command for the changes, stopping it if ctx is canceled.
+func run(ctx context.Context, ui ui, reason string, changes []change, line string) runResult {
+	var list string
+	if needsList(cmdArgs) {
+		var err error
+		if list, err = writeList(changes); err != nil {
+			log.Printf("Failed to write the list of changed files: %s", err)
+		}
+		defer os.Remove(list)
+	}
+	r := runResult{args: raceArgs(expandArgs(cmdArgs, changes, list)), reason: reason, changes: changes, line: line, start: time.Now()}
+	if *captureRuns {
+		r.capture = captureRun(ctx, os.Environ())
+	}
+	reportStarted(r)
 	ui.redisplay(func(out io.Writer) {
-		cmd := exec.Command(flag.Arg(0), flag.Args()[1:]...)
-		cmd.Stdout = out
-		cmd.Stderr = out
-		if hasSetPGID {
-			var attr syscall.SysProcAttr
-			reflect.ValueOf(&attr).Elem().FieldByName(setpgidName).SetBool(true)
-			cmd.SysProcAttr = &attr
-		}
-		io.WriteString(out, strings.Join(flag.Args(), " ")+"\n")
-		start := time.Now()
-		if err := cmd.Start(); err != nil {
-			io.WriteString(out, "fatal: "+err.Error()+"\n")
+		mw := jobOutput(out, filepath.Base(cmdArgs[0]))
+		defer mw.Flush()
+		out = mw
+		if *relPaths {
+			if dir, err := os.Getwd(); err == nil {
+				rw := newRelWriter(out, dir)
+				defer rw.Flush()
+				out = rw
+			}
+		}
+		io.WriteString(out, mw.status(strings.Join(r.args, " "))+"\n")
+		if r.capture != nil {
+			io.WriteString(out, mw.status(r.capture.header())+"\n")
+		}
+		r.start = time.Now()
+		cmd, err := command(child, r.args)
+		if err != nil {
+			io.WriteString(out, mw.status("fatal: "+err.Error())+"\n")
+			r.status, r.firstErr = -1, err.Error()
 			return
 		}
-		if s := wait(start, cmd); s != 0 {
-			io.WriteString(out, "exit status "+strconv.Itoa(s)+"\n")
+		if cmd.Env == nil {
+			cmd.Env = os.Environ()
+		}
+		cmd.Env = append(cmd.Env, runEnv(r)...)
+		setPGID(cmd)
+		o, err := pipeOutput(cmd)
+		if err == nil {
+			if err = cmd.Start(); err != nil {
+				o.close()
+			}
+		}
+		if err != nil {
+			io.WriteString(out, mw.status("fatal: "+err.Error())+"\n")
+			r.status, r.firstErr = -1, err.Error()
+			return
 		}
-		io.WriteString(out, time.Now().String()+"\n")
+		awaitRun(ctx, &r, cmd, o, out, mw)
 	})
+	if handedOff != nil {
+		// The upgraded binary reports it.
+		return r
+	}
 
-	return time.Now()
+	r.end = time.Now()
+	reportFinished(r)
+	ui.finished(r)
+	return r
 }
 
-func wait(start time.Time, cmd *exec.Cmd) int {
+// awaitRun copies the output of the command, started or adopted after
+// an upgrade, to out, and waits for it to exit, filling in r. Or, once
+// handOff is closed, it leaves the command to the upgraded binary.
+func awaitRun(ctx context.Context, r *runResult, cmd *exec.Cmd, o *runOutput, out io.Writer, mw *muxWriter) {
+	scan := &outputScanner{}
+	var mu sync.Mutex
+	stdout := &captureWriter{mu: &mu, w: io.MultiWriter(out, scan)}
+	stderr := &captureWriter{mu: &mu, w: stdout.w}
+	o.copy(stdout, stderr)
+	setRunning(cmd)
+	status, handedOver := wait(ctx, r.start, cmd)
+	if handedOver {
+		handedOff = o.detach(*r, cmd.Process.Pid)
+		// Not for stopRunning to stop it on the way out, but still
+		// recorded for the upgraded binary.
+		runningMu.Lock()
+		runningCmd = nil
+		runningMu.Unlock()
+		io.WriteString(out, mw.status("handed over to the upgraded Watch")+"\n")
+		return
+	}
+	o.wait()
+	r.status = status
+	setRunning(nil)
+	if r.status != 0 {
+		io.WriteString(out, mw.status("exit status "+strconv.Itoa(r.status))+"\n")
+	}
+	scan.Close()
+	r.firstErr, r.diags = scan.first, scan.diags
+	r.stdout, r.stderr = stdout.buf.Bytes(), stderr.buf.Bytes()
+	io.WriteString(out, mw.status(time.Now().String())+"\n")
+}
+
+// runStep runs the command of a step taken before the command's, such as
+// -gen, named by step, with its output going to out. Like the command, it
+// runs sandboxed, in its own process group, and recorded in the -audit log.
+// It is stopped if ctx is canceled.
+func runStep(ctx context.Context, out io.Writer, step string, args []string) error {
+	cmd, err := command(child, args)
+	if err != nil {
+		return err
+	}
+	cmd.Stdout, cmd.Stderr = out, out
+	setPGID(cmd)
+	r := runResult{args: args, reason: step, start: time.Now()}
+	if runAudit != nil {
+		runAudit.started(r)
+	}
+	if err = cmd.Start(); err == nil {
+		err = waitCommand(ctx, cmd)
+	}
+	r.end, r.status = time.Now(), cmd.ProcessState.ExitCode()
+	if runAudit != nil {
+		runAudit.finished(r)
+	}
+	return err
+}
+
+// setPGID has cmd start in a process group of its own, where supported,
+// so that pgid signals its children too.
+func setPGID(cmd *exec.Cmd) {
+	if !hasSetPGID {
+		return
+	}
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	reflect.ValueOf(cmd.SysProcAttr).Elem().FieldByName(setpgidName).SetBool(true)
+}
+
+// wait waits for the command to exit and returns its status. When ctx is
+// canceled, the command gets SIGTERM, then SIGKILL after -grace. When
+// handOff is closed, it returns at once, reporting that the command is
+// handed over.
+func wait(ctx context.Context, start time.Time, cmd *exec.Cmd) (int, bool) {
 	var n int
 	ticker := time.NewTicker(5 * time.Millisecond)
 	defer ticker.Stop()
+	canceled, force := ctx.Done(), (<-chan time.Time)(nil)
 	for {
 		select {
+		case <-canceled:
+			canceled, force = nil, time.After(*restartWait)
+			debugPrint("Sending SIGTERM")
+			syscall.Kill(pgid(cmd), syscall.SIGTERM)
+
+		case <-force:
+			debugPrint("Sending SIGKILL")
+			syscall.Kill(pgid(cmd), syscall.SIGKILL)
+
 		case t := <-killChan:
 			if t.Before(start) {
 				continue
 			}
-			p := cmd.Process.Pid
-			if hasSetPGID {
-				p = -p
-			}
 			if n == 0 {
 				debugPrint("Sending SIGTERM")
-				syscall.Kill(p, syscall.SIGTERM)
+				syscall.Kill(pgid(cmd), syscall.SIGTERM)
 			} else {
 				debugPrint("Sending SIGKILL")
-				syscall.Kill(p, syscall.SIGKILL)
+				syscall.Kill(pgid(cmd), syscall.SIGKILL)
 			}
 			n++
 
+		case <-handOff:
+			return -1, true
+
 		case <-ticker.C:
 			var status syscall.WaitStatus
 			p := cmd.Process.Pid
@@ -161,80 +1040,202 @@ func wait(start time.Time, cmd *exec.Cmd) int {
 				panic(err)
 			case q > 0:
 				cmd.Wait() // Clean up any goroutines created by cmd.Start.
-				return status.ExitStatus()
+				return status.ExitStatus(), false
 			}
 		}
 	}
 }
 
+// pgid returns the process to signal to stop the command: its process
+// group, if it has one.
+func pgid(cmd *exec.Cmd) int {
+	if hasSetPGID {
+		return -cmd.Process.Pid
+	}
+	return cmd.Process.Pid
+}
+
+// kill asks wait to stop the command: with SIGTERM
+// the first time, and with SIGKILL after that.
 func kill() {
 	select {
 	case killChan <- time.Now():
 		debugPrint("Killing")
+	default:
 	}
 }
 
-func startWatching(p string) <-chan time.Time {
+// startWatching watches the files and directories, directories
+// recursively, and returns a channel of their changes, until ctx is
+// canceled. Other sources of changes may send to the channel too.
+// The trigger file is in the first of the directories.
+func startWatching(ctx context.Context, paths []string) chan change {
 	w, err := fsnotify.NewWatcher()
 	if err != nil {
 		panic(err)
 	}
+	if *pollInterval > 0 {
+		polls = startPolling(*pollInterval)
+	}
 
-	switch isdir, err := isDir(p); {
-	case err != nil:
-		log.Fatalf("Failed to watch %s: %s", p, err)
-	case isdir:
-		watchDir(w, p)
-	default:
-		watch(w, p)
+	for _, p := range paths {
+		p = normName(shortPath(filepath.Clean(p)))
+		switch isdir, err := isDir(p); {
+		case err != nil:
+			log.Fatalf("Failed to watch %s: %s", p, err)
+		case isdir:
+			if triggerPath == "" {
+				triggerPath = filepath.Join(p, triggerFile)
+			}
+			ignoreRoots[p] = true
+			watchDir(w, p)
+		default:
+			watch(w, p)
+		}
 	}
 
-	changes := make(chan time.Time)
+	changes := make(chan change)
 
-	go sendChanges(w, changes)
+	go sendChanges(ctx, w, changes)
 
 	return changes
 }
 
-func sendChanges(w *fsnotify.Watcher, changes chan<- time.Time) {
+func sendChanges(ctx context.Context, w *fsnotify.Watcher, changes chan<- change) {
+	var rescans <-chan time.Time
+	if *rescanInterval > 0 {
+		t := time.NewTicker(*rescanInterval)
+		defer t.Stop()
+		rescans = t.C
+	}
 	for {
+		var (
+			ev  fsnotify.Event
+			sim bool // whether ev is simulated, and its file may not exist
+		)
 		select {
-		case err := <-w.Errors:
-			log.Fatalf("Watcher error: %s\n", err)
+		case <-ctx.Done():
+			debugPrint("Closing the watcher")
+			w.Close()
+			polls.close()
+			return
 
-		case ev := <-w.Events:
-			if excludeRe != nil && excludeRe.MatchString(ev.Name) {
-				debugPrint("ignoring event for excluded %s", ev.Name)
-				continue
+		case err, ok := <-w.Errors:
+			switch {
+			case err == fsnotify.ErrEventOverflow:
+				log.Printf("Watcher error: %s, looking for missed changes", err)
+			case ok:
+				log.Printf("Watcher error: %s, restarting the watcher", err)
+				w = restartWatcher(w)
+			default:
+				log.Printf("The watcher stopped, restarting it")
+				w = restartWatcher(w)
 			}
-			time, err := modTime(ev.Name)
-			if err != nil {
-				log.Printf("Failed to get even time: %s", err)
+			sendLost(w, changes)
+			continue
+
+		case req := <-watchRequests:
+			req.reply <- handleWatchRequest(w, req)
+			continue
+
+		case <-rescans:
+			for _, p := range rescan(w) {
+				explain(p, fsnotify.Create, "queued", "found by -rescan")
+				changes <- change{time: time.Now(), path: p, op: fsnotify.Create}
+			}
+			continue
+
+		case e, ok := <-w.Events:
+			if !ok {
+				log.Printf("The watcher stopped, restarting it")
+				w = restartWatcher(w)
+				sendLost(w, changes)
 				continue
 			}
+			ev = e
+		case ev = <-polls.eventsChan():
+		case ev = <-simulated:
+			sim = true
+		}
 
-			debugPrint("%s at %s", ev, time)
+		ev.Name = normName(shortPath(filepath.Clean(ev.Name)))
+		if ev.Name == triggerPath && ev.Op&(fsnotify.Remove|fsnotify.Rename) == 0 {
+			debugPrint("%s touched", triggerPath)
+			explain(ev.Name, ev.Op, "queued", "trigger file, not subject to filters")
+			changes <- change{time: time.Now(), path: ev.Name, op: ev.Op}
+			continue
+		}
+		if x := excludedBy(ev.Name); x != "" {
+			debugPrint("ignoring event for excluded %s", ev.Name)
+			explain(ev.Name, ev.Op, "excluded", "matches %s", x)
+			continue
+		}
+		if isIgnoreFile(ev.Name) {
+			loadIgnoreFile(ev.Name)
+		}
+		isdir, _ := isDir(ev.Name)
+		if rule := ignoredBy(ev.Name, isdir); rule != "" {
+			debugPrint("ignoring event for %s, ignored by %s", ev.Name, rule)
+			explain(ev.Name, ev.Op, "excluded", "ignored by %s", rule)
+			continue
+		}
+		if isOwnFile(ev.Name) {
+			explain(ev.Name, ev.Op, "ignored", "written by Watch")
+			continue
+		}
+		if isUnwatched(ev.Name) {
+			explain(ev.Name, ev.Op, "ignored", "removed from the watched paths")
+			continue
+		}
+		t, err := modTime(ev.Name)
+		if sim {
+			t, err = time.Now(), nil
+		}
+		if err != nil {
+			log.Printf("Failed to get even time: %s", err)
+			explain(ev.Name, ev.Op, "ignored", "failed to get its time: %s", err)
+			continue
+		}
 
-			if ev.Op&fsnotify.Create != 0 {
-				switch isdir, err := isDir(ev.Name); {
-				case err != nil:
-					log.Printf("Couldn't check if %s is a directory: %s", ev.Name, err)
-					continue
+		debugPrint("%s at %s", ev, t)
 
-				case isdir:
-					watchDir(w, ev.Name)
-				}
+		if dir := filepath.Dir(ev.Name); lazyDirs[dir] {
+			deepen(w, dir)
+		}
+
+		if ev.Op&fsnotify.Create != 0 {
+			switch isdir, err := isDir(ev.Name); {
+			case err != nil:
+				log.Printf("Couldn't check if %s is a directory: %s", ev.Name, err)
+				continue
+
+			case isdir:
+				watchDir(w, ev.Name)
 			}
+		}
 
-			changes <- time
+		// Drop the watches on a removed directory and everything below
+		// it, so that they are not leaked. A renamed directory is watched
+		// again under its new name when its creation there is seen. Its
+		// own watch also reports the rename, but under the new name.
+		if ev.Op&(fsnotify.Remove|fsnotify.Rename) != 0 && isWatched(ev.Name) && !exists(ev.Name) {
+			unwatchTree(w, ev.Name)
 		}
+
+		if why := ignoreReason(ev); why != "" {
+			debugPrint("ignoring event for %s: %s", ev.Name, why)
+			explain(ev.Name, ev.Op, "ignored", "%s", why)
+			continue
+		}
+
+		changes <- change{time: t, path: ev.Name, op: ev.Op}
 	}
 }
 
 func modTime(p string) (time.Time, error) {
 	switch s, err := os.Stat(p); {
 	case os.IsNotExist(err):
-		q := path.Dir(p)
+		q := filepath.Dir(p)
 		if q == p {
 			err := errors.New("Failed to find directory for " + p)
 			return time.Time{}, err
@@ -249,43 +1250,42 @@ func modTime(p string) (time.Time, error) {
 	}
 }
 
+// watchDir watches p and the directories below it.
 func watchDir(w *fsnotify.Watcher, p string) {
-	ents, err := ioutil.ReadDir(p)
-	switch {
-	case os.IsNotExist(err):
-		return
-
-	case err != nil:
-		log.Printf("Failed to watch %s: %s", p, err)
+	wk := newWalker()
+	start := time.Now()
+	wk.walk(p, 0, false)
+	for _, d := range wk.dirs {
+		watch(w, d)
 	}
-
-	for _, e := range ents {
-		sub := path.Join(p, e.Name())
-		if excludeRe != nil && excludeRe.MatchString(sub) {
-			debugPrint("excluding %s", sub)
-			continue
-		}
-		switch isdir, err := isDir(sub); {
-		case err != nil:
-			log.Printf("Failed to watch %s: %s", sub, err)
-
-		case isdir:
-			watchDir(w, sub)
-		}
+	for _, d := range wk.lazy {
+		lazyDirs[d] = true
 	}
-
-	watch(w, p)
+	debugPrint("Watched %d directories in %s in %s", len(wk.dirs), p, time.Since(start).Round(time.Millisecond))
 }
 
 func watch(w *fsnotify.Watcher, p string) {
 	debugPrint("Watching %s", p)
 
-	switch err := w.Add(p); {
+	if *pollInterval > 0 {
+		polls.add(p)
+		watched[p] = true
+		return
+	}
+
+	switch err := w.Add(longPath(p)); {
 	case os.IsNotExist(err):
 		debugPrint("%s no longer exists", p)
 
+	case err == syscall.ENOSPC:
+		pollInstead(p)
+		watched[p] = true
+
 	case err != nil:
 		log.Printf("Failed to watch %s: %s", p, err)
+
+	default:
+		watched[p] = true
 	}
 }
 
@@ -300,6 +1300,29 @@ func isDir(p string) (bool, error) {
 	}
 }
 
+func exists(p string) bool {
+	_, err := os.Lstat(p)
+	return err == nil
+}
+
+var cleanups []func()
+
+// atExit registers f to be called when Watch exits.
+func atExit(f func()) { cleanups = append(cleanups, f) }
+
+// exit runs the functions registered with atExit and exits.
+func exit(code int) {
+	runCleanups()
+	os.Exit(code)
+}
+
+// runCleanups runs the functions registered with atExit, latest first.
+func runCleanups() {
+	for i := len(cleanups) - 1; i >= 0; i-- {
+		cleanups[i]()
+	}
+}
+
 func debugPrint(f string, vals ...interface{}) {
 	if *debug {
 		log.Printf("DEBUG: "+f, vals...)
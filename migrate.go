@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	migrateDir = flag.String("migrate", "", "Apply new migration files in this directory before running the command")
+	migrateCmd = flag.String("migrate-cmd", "", "The database client that applies a migration, given its file as the last argument, e.g. \"psql postgres:///dev -v ON_ERROR_STOP=1 -f\"")
+)
+
+// checkMigrateFlags checks that -migrate and -migrate-cmd are given together.
+func checkMigrateFlags() error {
+	if (*migrateDir == "") != (*migrateCmd == "") {
+		return fmt.Errorf("-migrate and -migrate-cmd must be given together")
+	}
+	if *migrateCmd != "" && len(strings.Fields(*migrateCmd)) == 0 {
+		return fmt.Errorf("-migrate-cmd is empty")
+	}
+	return nil
+}
+
+// needsMigrate reports whether migrations may need applying.
+func needsMigrate(reason string, changes []change) bool {
+	if *migrateDir == "" {
+		return false
+	}
+	if reason == "start" {
+		return true
+	}
+	dir := filepath.Clean(*migrateDir)
+	for _, c := range changes {
+		if within(c.path, dir) {
+			return true
+		}
+	}
+	return false
+}
+
+// migrationState records the migrations applied by Watch, since it does
+// not read the database itself.
+type migrationState struct {
+	Applied []string `json:"applied"`
+}
+
+func migrationStatePath() (string, error) {
+	dir, err := filepath.Abs(*migrateDir)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(projectStateDir(dir), "migrations.json"), nil
+}
+
+// migrationVersion returns the number at the start of a migration's
+// file name, such as 42 for 0042_add_users.sql, or -1.
+func migrationVersion(name string) int {
+	i := 0
+	for i < len(name) && name[i] >= '0' && name[i] <= '9' {
+		i++
+	}
+	n, err := strconv.Atoi(name[:i])
+	if err != nil {
+		return -1
+	}
+	return n
+}
+
+// applyMigrations applies the migration files that have not been
+// applied yet, in order of version, and reports whether all succeeded.
+func applyMigrations(ctx context.Context, out io.Writer) bool {
+	fail := func(err error) bool {
+		io.WriteString(out, "migrate: "+err.Error()+"\n")
+		return false
+	}
+	statePath, err := migrationStatePath()
+	if err != nil {
+		return fail(err)
+	}
+	var st migrationState
+	switch b, err := ioutil.ReadFile(statePath); {
+	case os.IsNotExist(err):
+	case err != nil:
+		return fail(err)
+	default:
+		if err := json.Unmarshal(b, &st); err != nil {
+			return fail(fmt.Errorf("%s: %s", statePath, err))
+		}
+	}
+	applied := make(map[string]bool)
+	for _, name := range st.Applied {
+		applied[name] = true
+	}
+
+	names, err := filepath.Glob(filepath.Join(*migrateDir, "*.sql"))
+	if err != nil {
+		return fail(err)
+	}
+	for i := range names {
+		names[i] = filepath.Base(names[i])
+	}
+	sort.Slice(names, func(i, j int) bool {
+		vi, vj := migrationVersion(names[i]), migrationVersion(names[j])
+		if vi != vj {
+			return vi < vj
+		}
+		return names[i] < names[j]
+	})
+
+	args := strings.Fields(*migrateCmd)
+	if err := checkAllowed(args[0]); err != nil {
+		return fail(err)
+	}
+	for _, name := range names {
+		if applied[name] {
+			continue
+		}
+		io.WriteString(out, "migrate: applying "+name+"\n")
+		argv := append(append([]string(nil), args...), filepath.Join(*migrateDir, name))
+		if err := runStep(ctx, out, "migrate", argv); err != nil {
+			return fail(fmt.Errorf("%s: %s", name, err))
+		}
+		st.Applied = append(st.Applied, name)
+		b, err := json.MarshalIndent(st, "", "  ")
+		if err != nil {
+			return fail(err)
+		}
+		if err := os.MkdirAll(filepath.Dir(statePath), 0755); err != nil {
+			return fail(err)
+		}
+		if err := writeFileAtomic(statePath, b); err != nil {
+			return fail(err)
+		}
+		if v := migrationVersion(name); v >= 0 {
+			io.WriteString(out, "migrate: applied version "+strconv.Itoa(v)+"\n")
+		}
+	}
+	return true
+}
@@ -0,0 +1,165 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+func namespacesSupported() error { return nil }
+
+// namespaceAttr returns the process attributes that start the child in
+// the namespaces needed by c, or nil if it needs none. Unprivileged users
+// also get a user namespace, mapping only their own user and group,
+// which gives them the privileges needed to set up the others.
+func namespaceAttr(c *childConfig) *syscall.SysProcAttr {
+	var flags uintptr
+	if c.Unshare {
+		flags |= syscall.CLONE_NEWNS | syscall.CLONE_NEWPID
+	}
+	if c.ReadOnlyDir {
+		flags |= syscall.CLONE_NEWNS
+	}
+	if c.NoNetwork {
+		flags |= syscall.CLONE_NEWNET
+	}
+	if flags == 0 {
+		return nil
+	}
+	attr := &syscall.SysProcAttr{Cloneflags: flags}
+	if uid := os.Getuid(); uid != 0 {
+		gid := os.Getgid()
+		attr.Cloneflags |= syscall.CLONE_NEWUSER
+		attr.UidMappings = []syscall.SysProcIDMap{{ContainerID: uid, HostID: uid, Size: 1}}
+		attr.GidMappings = []syscall.SysProcIDMap{{ContainerID: gid, HostID: gid, Size: 1}}
+		attr.GidMappingsEnableSetgroups = false
+		// Keep the namespace's capabilities across executing Watch,
+		// which is not root in it; clearAmbientCaps drops them again.
+		attr.AmbientCaps = []uintptr{capNetAdmin, capSysAdmin}
+	}
+	return attr
+}
+
+// Capabilities and prctl options, from linux/capability.h and linux/prctl.h.
+const (
+	capNetAdmin          = 12
+	capSysAdmin          = 21
+	prCapAmbient         = 47
+	prCapAmbientClearAll = 4
+)
+
+// clearAmbientCaps drops the ambient capabilities of the calling
+// thread, so that the command does not inherit them.
+func clearAmbientCaps() error {
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prCapAmbient, prCapAmbientClearAll, 0); errno != 0 {
+		return os.NewSyscallError("prctl", errno)
+	}
+	return nil
+}
+
+// setupMounts sets up the child's mount namespace.
+func setupMounts(c *childConfig) error {
+	// Keep the mounts below from propagating back to the host.
+	if err := mount("none", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return err
+	}
+	if c.Unshare {
+		// Hold on to the project directory, which may be hidden by the new /tmp.
+		fd, err := syscall.Open(c.Dir, oPath|syscall.O_CLOEXEC, 0)
+		if err != nil {
+			return &os.PathError{Op: "open", Path: c.Dir, Err: err}
+		}
+		defer syscall.Close(fd)
+
+		if err := mount("proc", "/proc", "proc", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, ""); err != nil {
+			return err
+		}
+		if err := mount("tmpfs", "/tmp", "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "mode=1777"); err != nil {
+			return err
+		}
+		if err := os.MkdirAll(c.Dir, 0755); err != nil {
+			return err
+		}
+		if err := mount(fmt.Sprintf("/proc/self/fd/%d", fd), c.Dir, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+			return err
+		}
+	} else if c.ReadOnlyDir {
+		if err := mount(c.Dir, c.Dir, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+			return err
+		}
+	}
+
+	if c.ReadOnlyDir {
+		// A remount must keep the flags of the mount it was bound from
+		// that an unprivileged user namespace cannot clear.
+		var st syscall.Statfs_t
+		if err := syscall.Statfs(c.Dir, &st); err != nil {
+			return &os.PathError{Op: "statfs", Path: c.Dir, Err: err}
+		}
+		flags := uintptr(syscall.MS_BIND | syscall.MS_REMOUNT | syscall.MS_RDONLY)
+		for f, ms := range map[int64]uintptr{
+			stNoSuid:     syscall.MS_NOSUID,
+			stNoDev:      syscall.MS_NODEV,
+			stNoExec:     syscall.MS_NOEXEC,
+			stNoAtime:    syscall.MS_NOATIME,
+			stNoDirAtime: syscall.MS_NODIRATIME,
+			stRelAtime:   syscall.MS_RELATIME,
+		} {
+			if int64(st.Flags)&f != 0 {
+				flags |= ms
+			}
+		}
+		if err := mount("none", c.Dir, "", flags, ""); err != nil {
+			return err
+		}
+	}
+	// The working directory still refers to the mount it was on before.
+	return os.Chdir(c.Dir)
+}
+
+// Mount flags reported by statfs, from sys/statvfs.h.
+const (
+	stNoSuid     = 2
+	stNoDev      = 4
+	stNoExec     = 8
+	stNoAtime    = 1024
+	stNoDirAtime = 2048
+	stRelAtime   = 4096
+)
+
+func mount(source, target, fstype string, flags uintptr, data string) error {
+	if err := syscall.Mount(source, target, fstype, flags, data); err != nil {
+		return &os.PathError{Op: "mount", Path: target, Err: err}
+	}
+	return nil
+}
+
+// loopbackUp brings up the loopback interface of a new network
+// namespace, so that the command can still use localhost.
+func loopbackUp() error {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return os.NewSyscallError("socket", err)
+	}
+	defer syscall.Close(fd)
+
+	// struct ifreq: the interface name followed by a union, here the flags.
+	var ifr struct {
+		name  [syscall.IFNAMSIZ]byte
+		flags uint16
+		_     [22]byte
+	}
+	copy(ifr.name[:], "lo")
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.SIOCGIFFLAGS, uintptr(unsafe.Pointer(&ifr))); errno != 0 {
+		return os.NewSyscallError("ioctl", errno)
+	}
+	ifr.flags |= syscall.IFF_UP
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.SIOCSIFFLAGS, uintptr(unsafe.Pointer(&ifr))); errno != 0 {
+		return os.NewSyscallError("ioctl", errno)
+	}
+	return nil
+}
@@ -0,0 +1,21 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+func namespacesSupported() error {
+	return errors.New("namespaces are only supported on Linux")
+}
+
+func namespaceAttr(c *childConfig) *syscall.SysProcAttr { return nil }
+
+func setupMounts(c *childConfig) error { return namespacesSupported() }
+
+func loopbackUp() error { return namespacesSupported() }
+
+func clearAmbientCaps() error { return nil }
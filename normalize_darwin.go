@@ -0,0 +1,9 @@
+package main
+
+import "golang.org/x/text/unicode/norm"
+
+// normName returns the NFC form of the file name s.
+// macOS file systems report names in NFD, with accents as separate
+// combining characters, while patterns and paths typed by users are
+// almost always NFC. Both file systems accept either form.
+func normName(s string) string { return norm.NFC.String(s) }
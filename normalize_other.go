@@ -0,0 +1,8 @@
+//go:build !darwin
+// +build !darwin
+
+package main
+
+// normName returns the file name s unchanged. Other systems
+// treat names differing in normalization as different files.
+func normName(s string) string { return s }
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+)
+
+var (
+	notifyURLs     stringList
+	notifyTmpl     = flag.String("notify-template", defaultNotifyTmpl, "The Go template used for notification messages")
+	notifyInterval = flag.Duration("notify-interval", 0, "Send at most one notification per interval to each webhook, summarizing the runs in between")
+)
+
+func init() {
+	flag.Var(&notifyURLs, "notify", "Post a message to this webhook URL after each run (may be repeated)")
+}
+
+const defaultNotifyTmpl = `{{if gt .Runs 1}}{{.Runs}} runs, {{.Failures}} failed; last: {{end}}` +
+	`{{.Command}}: {{if .OK}}ok{{else}}failed ({{.ExitCode}}){{end}} in {{.Duration}}{{with .FirstError}}: {{.}}{{end}}`
+
+// A notification is the run metadata available to notification templates.
+// When several runs are grouped into one message, it describes the last
+// of them, and Runs and Failures count all of them.
+type notification struct {
+	Command    string
+	ExitCode   int
+	OK         bool
+	Start      time.Time
+	Duration   time.Duration
+	FirstError string
+	Files      []string
+	Runs       int
+	Failures   int
+}
+
+type notifier struct {
+	channels []*channel
+}
+
+// A channel is a single webhook with its own rate limit.
+type channel struct {
+	url      string
+	interval time.Duration
+	tmpl     *template.Template
+	runs     chan notification
+}
+
+// newNotifier returns a notifier for the -notify flags,
+// or nil if notifications are disabled.
+func newNotifier() (reporter, error) {
+	if len(notifyURLs) == 0 {
+		return nil, nil
+	}
+	t, err := template.New("notify").Parse(*notifyTmpl)
+	if err != nil {
+		return nil, fmt.Errorf("Bad notification template: %s", err)
+	}
+	n := &notifier{}
+	for _, u := range notifyURLs {
+		c := &channel{url: u, interval: *notifyInterval, tmpl: t, runs: make(chan notification, 16)}
+		go c.loop()
+		n.channels = append(n.channels, c)
+	}
+	return n, nil
+}
+
+func (n *notifier) started(runResult) {}
+
+func (n *notifier) finished(r runResult) {
+	d := notification{
+		Command:    strings.Join(r.args, " "),
+		ExitCode:   r.status,
+		OK:         r.status == 0,
+		Start:      r.start,
+		Duration:   r.end.Sub(r.start).Round(time.Millisecond),
+		FirstError: r.firstErr,
+		Files:      r.files(),
+		Runs:       1,
+	}
+	if !d.OK {
+		d.Failures = 1
+	}
+	for _, c := range n.channels {
+		select {
+		case c.runs <- d:
+		default:
+			debugPrint("dropping notification for %s", c.url)
+		}
+	}
+}
+
+func (n *notifier) alert(msg string) {
+	for _, c := range n.channels {
+		go c.post(msg)
+	}
+}
+
+// loop sends a message for each run, holding back runs that arrive
+// within the interval after a message and summarizing them in a
+// single message once the interval has passed.
+func (c *channel) loop() {
+	var (
+		last    time.Time
+		held    *notification
+		release <-chan time.Time
+	)
+	for {
+		select {
+		case d := <-c.runs:
+			if held != nil {
+				d.Runs += held.Runs
+				d.Failures += held.Failures
+				held = &d
+				continue
+			}
+			if wait := c.interval - time.Since(last); wait > 0 {
+				held = &d
+				release = time.After(wait)
+				continue
+			}
+			c.send(d)
+			last = time.Now()
+
+		case <-release:
+			c.send(*held)
+			held, release = nil, nil
+			last = time.Now()
+		}
+	}
+}
+
+func (c *channel) send(d notification) {
+	var b bytes.Buffer
+	if err := c.tmpl.Execute(&b, d); err != nil {
+		log.Printf("Failed to format notification: %s", err)
+		return
+	}
+	c.post(b.String())
+}
+
+// post sends msg to the webhook as a Slack-style {"text": msg} payload.
+func (c *channel) post(msg string) {
+	body, err := json.Marshal(struct {
+		Text string `json:"text"`
+	}{msg})
+	if err != nil {
+		log.Printf("Failed to encode notification: %s", err)
+		return
+	}
+	resp, err := http.Post(c.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Printf("Failed to send notification: %s", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		log.Printf("Failed to send notification: %s", resp.Status)
+	}
+}
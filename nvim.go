@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"sort"
+	"strings"
+)
+
+var nvimAddr = flag.String("nvim", "", "Populate the quickfix list of the Neovim listening on this socket with each run's errors")
+
+// An nvimReporter sets the quickfix list of a running Neovim
+// to the diagnostics of each run, using msgpack-RPC.
+type nvimReporter struct {
+	addr  string
+	conn  net.Conn
+	msgid uint32
+}
+
+// newNvimReporter returns an nvimReporter for the -nvim
+// flag, or nil if no Neovim socket was given.
+func newNvimReporter() (reporter, error) {
+	if *nvimAddr == "" {
+		return nil, nil
+	}
+	return &nvimReporter{addr: *nvimAddr}, nil
+}
+
+func (n *nvimReporter) started(runResult) {}
+
+func (n *nvimReporter) finished(r runResult) {
+	if r.rule != "" {
+		return // Rules' runs have no diagnostics to replace the list with.
+	}
+	items := make([]interface{}, 0, len(r.diags))
+	for _, d := range r.diags {
+		typ := "E"
+		if d.warning() {
+			typ = "W"
+		}
+		items = append(items, map[string]interface{}{
+			"filename": absPath(d.File),
+			"lnum":     d.Line,
+			"col":      d.Col,
+			"text":     d.Message,
+			"type":     typ,
+		})
+	}
+	what := map[string]interface{}{
+		"title": "Watch: " + strings.Join(r.args, " "),
+		"items": items,
+	}
+	// setqflist([], 'r', what) replaces the current quickfix list.
+	if err := n.call("nvim_call_function", "setqflist", []interface{}{[]interface{}{}, "r", what}); err != nil {
+		log.Printf("Failed to set the Neovim quickfix list: %s", err)
+	}
+}
+
+// call sends a msgpack-RPC request, connecting to Neovim if needed.
+// Responses are discarded.
+func (n *nvimReporter) call(method string, params ...interface{}) error {
+	if n.conn == nil {
+		network := "unix"
+		if !strings.Contains(n.addr, "/") && strings.Contains(n.addr, ":") {
+			network = "tcp"
+		}
+		c, err := net.Dial(network, n.addr)
+		if err != nil {
+			return err
+		}
+		n.conn = c
+		go io.Copy(ioutil.Discard, c)
+	}
+	n.msgid++
+	var b bytes.Buffer
+	if err := msgpackEncode(&b, []interface{}{0, n.msgid, method, params}); err != nil {
+		return err
+	}
+	if _, err := n.conn.Write(b.Bytes()); err != nil {
+		n.conn.Close()
+		n.conn = nil
+		return err
+	}
+	return nil
+}
+
+// msgpackEncode writes v to b in MessagePack format. It supports
+// just the types needed for Neovim requests.
+func msgpackEncode(b *bytes.Buffer, v interface{}) error {
+	switch v := v.(type) {
+	case nil:
+		b.WriteByte(0xc0)
+	case bool:
+		if v {
+			b.WriteByte(0xc3)
+		} else {
+			b.WriteByte(0xc2)
+		}
+	case int:
+		b.WriteByte(0xd3)
+		binary.Write(b, binary.BigEndian, int64(v))
+	case uint32:
+		b.WriteByte(0xce)
+		binary.Write(b, binary.BigEndian, v)
+	case string:
+		switch n := len(v); {
+		case n < 32:
+			b.WriteByte(0xa0 | byte(n))
+		case n < 1<<8:
+			b.WriteByte(0xd9)
+			b.WriteByte(byte(n))
+		case n < 1<<16:
+			b.WriteByte(0xda)
+			binary.Write(b, binary.BigEndian, uint16(n))
+		default:
+			b.WriteByte(0xdb)
+			binary.Write(b, binary.BigEndian, uint32(n))
+		}
+		b.WriteString(v)
+	case []interface{}:
+		if n := len(v); n < 16 {
+			b.WriteByte(0x90 | byte(n))
+		} else {
+			b.WriteByte(0xdd)
+			binary.Write(b, binary.BigEndian, uint32(n))
+		}
+		for _, e := range v {
+			if err := msgpackEncode(b, e); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		if n := len(v); n < 16 {
+			b.WriteByte(0x80 | byte(n))
+		} else {
+			b.WriteByte(0xdf)
+			binary.Write(b, binary.BigEndian, uint32(n))
+		}
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			msgpackEncode(b, k)
+			if err := msgpackEncode(b, v[k]); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("cannot encode %T as msgpack", v)
+	}
+	return nil
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+var relPaths = flag.Bool("rel", false, "Rewrite absolute paths in the output below the working directory as relative paths, for acme addressing")
+
+// absPathRe matches absolute paths at the start of a word.
+var absPathRe = regexp.MustCompile(`(^|[\s('"=\[])(/[^\s:'"()\[\]]+)`)
+
+// A relWriter rewrites absolute paths below dir as relative
+// paths in the lines written through it to w.
+type relWriter struct {
+	w    io.Writer
+	dir  string
+	line []byte
+}
+
+func newRelWriter(w io.Writer, dir string) *relWriter {
+	return &relWriter{w: w, dir: dir}
+}
+
+func (r *relWriter) Write(p []byte) (int, error) {
+	r.line = append(r.line, p...)
+	for {
+		i := bytes.IndexByte(r.line, '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+		if _, err := io.WriteString(r.w, r.rewrite(string(r.line[:i+1]))); err != nil {
+			return len(p), err
+		}
+		r.line = r.line[i+1:]
+	}
+}
+
+// Flush writes any final unterminated line.
+func (r *relWriter) Flush() error {
+	if len(r.line) == 0 {
+		return nil
+	}
+	_, err := io.WriteString(r.w, r.rewrite(string(r.line)))
+	r.line = nil
+	return err
+}
+
+func (r *relWriter) rewrite(l string) string {
+	return absPathRe.ReplaceAllStringFunc(l, func(m string) string {
+		i := strings.IndexByte(m, '/')
+		p := m[i:]
+		rel, err := filepath.Rel(r.dir, p)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+			return m
+		}
+		return m[:i] + rel
+	})
+}
+
+var (
+	prefixOutput = flag.Bool("prefix", false, "Prefix each line of output with the name of the job that wrote it, such as [go] or [gen]")
+	colorMode    = flag.String("color", "auto", "Color each job's prefix and status lines: auto (when writing to a terminal), always, or never")
+)
+
+// jobColors are the ANSI colors given to jobs, avoiding red and green,
+// which mean failure and success.
+var jobColors = []string{"36", "33", "35", "34", "96", "93", "95", "94"}
+
+// colorEnabled is whether -color applies.
+var colorEnabled bool
+
+// setupColor decides whether to use color.
+func setupColor() error {
+	switch *colorMode {
+	case "always":
+		colorEnabled = true
+	case "never":
+	case "auto":
+		fi, err := os.Stdout.Stat()
+		colorEnabled = err == nil && fi.Mode()&os.ModeCharDevice != 0 &&
+			os.Getenv("TERM") != "dumb" && os.Getenv("NO_COLOR") == ""
+	default:
+		return fmt.Errorf("unknown -color %q", *colorMode)
+	}
+	return nil
+}
+
+// jobColor returns the color of the named job, which is always the same.
+func jobColor(name string) string {
+	h := fnv.New32a()
+	io.WriteString(h, name)
+	return jobColors[h.Sum32()%uint32(len(jobColors))]
+}
+
+// maxCapture is how much of each of the command's output streams is
+// kept in its runResult.
+const maxCapture = 1 << 20
+
+// A captureWriter writes one of the command's output streams to w, which
+// it shares with the other, and keeps up to maxCapture bytes of it.
+type captureWriter struct {
+	mu  *sync.Mutex
+	w   io.Writer
+	buf bytes.Buffer
+}
+
+func (c *captureWriter) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if n := maxCapture - c.buf.Len(); n > 0 {
+		if n > len(p) {
+			n = len(p)
+		}
+		c.buf.Write(p[:n])
+	}
+	return c.w.Write(p)
+}
+
+// outputMu serializes the lines written by concurrent jobs, so that
+// their output never interleaves within a line.
+var outputMu sync.Mutex
+
+// A muxWriter buffers what a job writes to w, and writes it a whole
+// line at a time, optionally prefixed, while holding outputMu.
+type muxWriter struct {
+	w      io.Writer
+	prefix string
+	// color is the job's ANSI color, if color is enabled.
+	color string
+	line  []byte
+}
+
+// jobOutput returns a muxWriter for the output of the named job,
+// prefixing its lines with the name with -prefix.
+func jobOutput(w io.Writer, name string) *muxWriter {
+	if *prefixOutput {
+		return prefixedOutput(w, name)
+	}
+	m := &muxWriter{w: w}
+	if colorEnabled {
+		m.color = jobColor(name)
+	}
+	return m
+}
+
+// prefixedOutput returns a muxWriter for the output of the named job,
+// always prefixing its lines with the name.
+func prefixedOutput(w io.Writer, name string) *muxWriter {
+	m := &muxWriter{w: w}
+	if colorEnabled {
+		m.color = jobColor(name)
+	}
+	m.prefix = m.colored("["+name+"]") + " "
+	return m
+}
+
+// colored returns s in the job's color, if it has one.
+func (m *muxWriter) colored(s string) string {
+	if m.color == "" {
+		return s
+	}
+	return "\x1b[" + m.color + "m" + s + "\x1b[0m"
+}
+
+// status returns a status line about the job, such as its exit status,
+// in bold and the job's color.
+func (m *muxWriter) status(s string) string {
+	if m.color == "" {
+		return s
+	}
+	return "\x1b[1;" + m.color + "m" + s + "\x1b[0m"
+}
+
+func (m *muxWriter) Write(p []byte) (int, error) {
+	m.line = append(m.line, p...)
+	i := bytes.LastIndexByte(m.line, '\n')
+	if i < 0 {
+		return len(p), nil
+	}
+	err := m.write(m.line[:i+1])
+	m.line = m.line[i+1:]
+	return len(p), err
+}
+
+// Flush writes any final unterminated line, terminating it.
+func (m *muxWriter) Flush() error {
+	if len(m.line) == 0 {
+		return nil
+	}
+	err := m.write(append(m.line, '\n'))
+	m.line = nil
+	return err
+}
+
+// write writes complete lines.
+func (m *muxWriter) write(lines []byte) error {
+	if m.prefix != "" {
+		var b bytes.Buffer
+		for _, l := range bytes.SplitAfter(lines, []byte("\n")) {
+			if len(l) > 0 {
+				b.WriteString(m.prefix)
+				b.Write(l)
+			}
+		}
+		lines = b.Bytes()
+	}
+	outputMu.Lock()
+	defer outputMu.Unlock()
+	_, err := m.w.Write(lines)
+	return err
+}
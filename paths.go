@@ -0,0 +1,206 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// triggerFile is the name of the file in the watched directory that
+// forces a run when it is touched, whatever the filters say.
+// Like other changes, touches are debounced.
+const triggerFile = ".watch-trigger"
+
+// triggerPath is the trigger file of the watched directory, if it is one.
+var triggerPath string
+
+// A watchRequest asks the watcher to change what it watches while running.
+type watchRequest struct {
+	op    string // add, add-file, or remove
+	path  string
+	reply chan error
+}
+
+// watchRequests receives requests to change the watched paths,
+// which are handled by the goroutine that reads the watcher's events.
+var watchRequests = make(chan watchRequest)
+
+// changeWatch asks the watcher to apply op to the path, and waits for it.
+func changeWatch(op, p string) error {
+	req := watchRequest{op: op, path: p, reply: make(chan error, 1)}
+	watchRequests <- req
+	return <-req.reply
+}
+
+// handleWatchRequest applies req to w.
+func handleWatchRequest(w *fsnotify.Watcher, req watchRequest) error {
+	p := watchedName(req.path)
+	switch req.op {
+	case "add":
+		switch fi, err := os.Stat(p); {
+		case err != nil:
+			return err
+		case !fi.IsDir():
+			return fmt.Errorf("%s is not a directory", p)
+		}
+		debugPrint("Adding %s", p)
+		for r := range unwatched {
+			if within(p, r) || within(r, p) {
+				delete(unwatched, r)
+			}
+		}
+		ignoreRoots[p] = true
+		watchDir(w, p)
+		return nil
+
+	case "add-file":
+		if _, err := os.Stat(p); err != nil {
+			return err
+		}
+		if watched[filepath.Dir(p)] {
+			// Already watched through its directory.
+			return nil
+		}
+		watch(w, p)
+		return nil
+
+	case "remove":
+		if !isWatched(p) {
+			return fmt.Errorf("%s is not watched", p)
+		}
+		debugPrint("Removing %s", p)
+		unwatched[p] = true
+		unwatchTree(w, p)
+		return nil
+	}
+	return fmt.Errorf("unknown watch request %q", req.op)
+}
+
+// watchedName returns p as it would be named in events: relative to the
+// working directory if it is below it, as the initial paths are.
+func watchedName(p string) string {
+	p = filepath.Clean(p)
+	if filepath.IsAbs(p) {
+		if wd, err := os.Getwd(); err == nil {
+			if rel, err := filepath.Rel(wd, p); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+				p = rel
+			}
+		}
+	}
+	return normName(shortPath(p))
+}
+
+// watched is the set of paths added to the watcher, and unwatched the
+// subtrees removed at runtime, which stay ignored even if recreated.
+// Once watching has started, both are only used by sendChanges.
+var (
+	watched   = make(map[string]bool)
+	unwatched = make(map[string]bool)
+)
+
+// isWatched reports whether p or anything below it is watched.
+func isWatched(p string) bool {
+	for q := range watched {
+		if within(q, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// isUnwatched reports whether p is in a subtree removed at runtime.
+func isUnwatched(p string) bool {
+	for r := range unwatched {
+		if within(p, r) {
+			return true
+		}
+	}
+	return false
+}
+
+// unwatchTree stops watching p and everything below it.
+func unwatchTree(w *fsnotify.Watcher, p string) {
+	for q := range watched {
+		if !within(q, p) {
+			continue
+		}
+		debugPrint("Unwatching %s", q)
+		// The watch is already gone if the directory was removed.
+		w.Remove(longPath(q))
+		polls.remove(q)
+		delete(watched, q)
+		delete(lazyDirs, q)
+	}
+}
+
+// within reports whether p is dir or below it.
+func within(p, dir string) bool {
+	if dir == "." {
+		return !filepath.IsAbs(p) && p != ".." && !strings.HasPrefix(p, ".."+string(filepath.Separator))
+	}
+	return p == dir || strings.HasPrefix(p, dir+string(filepath.Separator))
+}
+
+// expandRoot expands environment variables and a leading ~ in a path
+// to watch, and if it is then a glob, such as ./services/*/src, returns
+// the paths that match it.
+func expandRoot(p string) ([]string, error) {
+	p = os.ExpandEnv(p)
+	if p == "~" || strings.HasPrefix(p, "~/") {
+		p = filepath.Join(os.Getenv("HOME"), p[1:])
+	}
+	if !isGlob(p) {
+		return []string{p}, nil
+	}
+	m, err := filepath.Glob(p)
+	if err != nil {
+		return nil, fmt.Errorf("bad pattern %s: %s", p, err)
+	}
+	return m, nil
+}
+
+// isGlob reports whether p is a glob rather than a path.
+func isGlob(p string) bool {
+	return strings.ContainsAny(p, "*?[")
+}
+
+var globRescan = flag.Duration("glob-rescan", 2*time.Second, "How often to look for new paths matching the globs given with -p, or 0 not to")
+
+// watchNewMatches starts watching paths that come to match the globs,
+// such as a newly scaffolded service in a monorepo, until Watch exits.
+// The roots are those already watched.
+func watchNewMatches(globs, roots []string) {
+	seen := make(map[string]bool)
+	for _, p := range roots {
+		seen[watchedName(p)] = true
+	}
+	for range time.Tick(*globRescan) {
+		for _, g := range globs {
+			m, err := expandRoot(g)
+			if err != nil {
+				continue
+			}
+			for _, p := range m {
+				if seen[watchedName(p)] {
+					continue
+				}
+				seen[watchedName(p)] = true
+				op := "add"
+				if isdir, _ := isDir(p); !isdir {
+					op = "add-file"
+				}
+				if err := changeWatch(op, p); err != nil {
+					log.Printf("Failed to watch %s: %s", p, err)
+					continue
+				}
+				log.Printf("Watching %s, which matches %s", p, g)
+			}
+		}
+	}
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+)
+
+// pauses receives "pause", "resume", or "toggle" whenever pausing
+// is requested through the control socket or pauseSignal.
+var pauses = make(chan string, 1)
+
+// notifyPause toggles pausing on pauseSignal, where there is one.
+func notifyPause() {
+	if pauseSignal == nil {
+		return
+	}
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, pauseSignal)
+	go func() {
+		for range sigs {
+			pauses <- "toggle"
+		}
+	}()
+}
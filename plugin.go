@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+var pluginFlags stringList
+
+func init() {
+	flag.Var(&pluginFlags, "plugin", "Run this plugin executable, in addition to those in the plugins directory (may be repeated)")
+}
+
+// pluginTimeout is how long a filter plugin may take to decide on an
+// event before the event is let through.
+const pluginTimeout = time.Second
+
+// pluginDir returns the directory from which plugins are loaded.
+func pluginDir() string {
+	if d := os.Getenv("XDG_CONFIG_HOME"); d != "" {
+		return filepath.Join(d, "watch", "plugins")
+	}
+	return filepath.Join(os.Getenv("HOME"), ".config", "watch", "plugins")
+}
+
+// A pluginMessage is a line exchanged with a plugin. Watch sends hello,
+// event, run-started, and run-finished messages, and plugins send
+// hello, decision, and trigger messages.
+type pluginMessage struct {
+	Type    string  `json:"type"`
+	Version int     `json:"version,omitempty"`
+	Dir     string  `json:"dir,omitempty"`
+	ID      int     `json:"id,omitempty"`
+	Path    string  `json:"path,omitempty"`
+	Op      string  `json:"op,omitempty"`
+	Run     *ctlRun `json:"run,omitempty"`
+	// Filter and Events say in a plugin's hello what it wants to be sent.
+	Filter bool `json:"filter,omitempty"`
+	Events bool `json:"events,omitempty"`
+	// Ignore and Reason are a filter plugin's decision on an event.
+	Ignore bool   `json:"ignore,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// A plugin is a running plugin process.
+type plugin struct {
+	name   string
+	filter bool
+	events bool
+
+	mu        sync.Mutex
+	enc       *json.Encoder
+	nextID    int
+	decisions map[int]chan pluginMessage
+}
+
+// plugins are the running plugins.
+var plugins []*plugin
+
+// newPlugins starts the plugins, and returns a reporter sending run
+// events to those that want them.
+func newPlugins() (reporter, error) {
+	paths := append([]string(nil), pluginFlags...)
+	ents, err := ioutil.ReadDir(pluginDir())
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, e := range ents {
+		if e.Mode().IsRegular() && e.Mode()&0111 != 0 {
+			paths = append(paths, filepath.Join(pluginDir(), e.Name()))
+		}
+	}
+	sort.Strings(paths[len(pluginFlags):])
+
+	dir, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range paths {
+		pl, err := startPlugin(p, dir)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to start plugin %s: %s", p, err)
+		}
+		plugins = append(plugins, pl)
+	}
+	if len(plugins) == 0 {
+		return nil, nil
+	}
+	return pluginReporter{}, nil
+}
+
+// startPlugin starts the plugin at p and waits for its hello.
+func startPlugin(p, dir string) (*plugin, error) {
+	if err := checkAllowed(p); err != nil {
+		return nil, err
+	}
+	cmd := exec.Command(p)
+	// Plugins write to standard error while the command runs.
+	cmd.Stderr = prefixedOutput(os.Stderr, filepath.Base(p))
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	atExit(func() { in.Close() })
+
+	pl := &plugin{name: filepath.Base(p), enc: json.NewEncoder(in), decisions: make(map[int]chan pluginMessage)}
+	if err := pl.enc.Encode(pluginMessage{Type: "hello", Version: ctlVersion, Dir: dir}); err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bufio.NewReader(out))
+	var hello pluginMessage
+	if err := dec.Decode(&hello); err != nil {
+		return nil, fmt.Errorf("no hello: %s", err)
+	}
+	if hello.Type != "hello" {
+		return nil, fmt.Errorf("got %q message instead of hello", hello.Type)
+	}
+	pl.filter, pl.events = hello.Filter, hello.Events
+	debugPrint("Started plugin %s (filter: %t, events: %t)", pl.name, pl.filter, pl.events)
+	go pl.read(dec)
+	return pl, nil
+}
+
+// read handles the messages sent by the plugin until it exits.
+func (pl *plugin) read(dec *json.Decoder) {
+	for {
+		var m pluginMessage
+		if err := dec.Decode(&m); err != nil {
+			if err != io.EOF {
+				log.Printf("Plugin %s: %s", pl.name, err)
+			}
+			log.Printf("Plugin %s exited", pl.name)
+			pl.mu.Lock()
+			pl.filter, pl.events = false, false
+			pl.mu.Unlock()
+			return
+		}
+		switch m.Type {
+		case "decision":
+			pl.mu.Lock()
+			c := pl.decisions[m.ID]
+			delete(pl.decisions, m.ID)
+			pl.mu.Unlock()
+			if c != nil {
+				c <- m
+			}
+		case "trigger":
+			debugPrint("Plugin %s triggered a run", pl.name)
+			select {
+			case triggers <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// send sends a run event to the plugin if it wants them.
+func (pl *plugin) send(m pluginMessage) {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	if !pl.events {
+		return
+	}
+	if err := pl.enc.Encode(m); err != nil {
+		log.Printf("Failed to write to plugin %s: %s", pl.name, err)
+	}
+}
+
+// ignore asks a filter plugin whether to ignore the event. Events are let
+// through if the plugin does not answer in time.
+func (pl *plugin) ignore(ev fsnotify.Event) (string, bool) {
+	pl.mu.Lock()
+	if !pl.filter {
+		pl.mu.Unlock()
+		return "", false
+	}
+	pl.nextID++
+	id := pl.nextID
+	c := make(chan pluginMessage, 1)
+	pl.decisions[id] = c
+	err := pl.enc.Encode(pluginMessage{Type: "event", ID: id, Path: ev.Name, Op: strings.ToLower(ev.Op.String())})
+	pl.mu.Unlock()
+	if err != nil {
+		log.Printf("Failed to write to plugin %s: %s", pl.name, err)
+		return "", false
+	}
+
+	select {
+	case m := <-c:
+		if m.Reason == "" {
+			m.Reason = "ignored"
+		}
+		return m.Reason, m.Ignore
+	case <-time.After(pluginTimeout):
+		pl.mu.Lock()
+		delete(pl.decisions, id)
+		pl.mu.Unlock()
+		log.Printf("Plugin %s did not decide on %s in time", pl.name, ev.Name)
+		return "", false
+	}
+}
+
+// pluginIgnoreReason returns why a plugin ignores the event, or "".
+func pluginIgnoreReason(ev fsnotify.Event) string {
+	for _, pl := range plugins {
+		if why, ok := pl.ignore(ev); ok {
+			return fmt.Sprintf("plugin %s: %s", pl.name, why)
+		}
+	}
+	return ""
+}
+
+// A pluginReporter sends run events to the plugins that want them.
+type pluginReporter struct{}
+
+func (pluginReporter) started(r runResult) {
+	for _, pl := range plugins {
+		pl.send(pluginMessage{Type: "run-started", Run: &ctlRun{Command: r.args, Start: r.start}})
+	}
+}
+
+func (pluginReporter) finished(r runResult) {
+	run := &ctlRun{Command: r.args, Start: r.start, End: &r.end, ExitStatus: &r.status, Files: r.files()}
+	for _, pl := range plugins {
+		pl.send(pluginMessage{Type: "run-finished", Run: run})
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+var pollInterval = flag.Duration("poll", 0, "Poll the watched files for changes at this interval instead of using file system events, for network file systems and container bind mounts")
+
+// A poller finds changes by comparing the watched paths to how they were
+// at the last poll, and sends them as the events fsnotify would have.
+// Like fsnotify, a directory's events are for the entries directly in it,
+// and renames are seen as a removal and a creation.
+type poller struct {
+	events chan fsnotify.Event
+	stop   chan struct{}
+
+	mu sync.Mutex
+	// paths maps the watched paths to their entries at the last poll,
+	// by name, or for files, to the file itself, named "".
+	paths map[string]map[string]polledEntry
+}
+
+type polledEntry struct {
+	fileState
+	dir bool
+}
+
+// polls is the poller, if anything is polled. It is only used by the
+// goroutine that reads the watcher's events.
+var polls *poller
+
+// fallbackPollInterval is how often paths that could not be watched
+// for lack of inotify watches are polled instead.
+const fallbackPollInterval = 2 * time.Second
+
+// pollInstead polls p, which could not be watched because the limit on
+// inotify watches has been reached, explaining how to raise it the
+// first time.
+func pollInstead(p string) {
+	if polls == nil {
+		log.Printf("Out of inotify watches: polling %s and any other directories that cannot be watched every %s. "+
+			"To watch them instead, raise the limit, e.g. with: sudo sysctl fs.inotify.max_user_watches=524288",
+			p, fallbackPollInterval)
+		polls = startPolling(fallbackPollInterval)
+	}
+	debugPrint("Polling %s", p)
+	polls.add(p)
+}
+
+// startPolling starts a poller polling at the interval.
+func startPolling(interval time.Duration) *poller {
+	p := &poller{
+		events: make(chan fsnotify.Event, 256),
+		stop:   make(chan struct{}),
+		paths:  make(map[string]map[string]polledEntry),
+	}
+	go p.run(interval)
+	return p
+}
+
+// eventsChan returns the channel of the poller's events, which is
+// nil if there is no poller.
+func (p *poller) eventsChan() <-chan fsnotify.Event {
+	if p == nil {
+		return nil
+	}
+	return p.events
+}
+
+func (p *poller) add(path string) {
+	entries := scanPolled(path)
+	p.mu.Lock()
+	p.paths[path] = entries
+	p.mu.Unlock()
+}
+
+func (p *poller) remove(path string) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	delete(p.paths, path)
+	p.mu.Unlock()
+}
+
+// polling reports whether path is polled.
+func (p *poller) polling(path string) bool {
+	if p == nil {
+		return false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, ok := p.paths[path]
+	return ok
+}
+
+func (p *poller) close() {
+	if p != nil {
+		close(p.stop)
+	}
+}
+
+func (p *poller) run(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-t.C:
+		}
+		for _, ev := range p.poll() {
+			select {
+			case p.events <- ev:
+			case <-p.stop:
+				return
+			}
+		}
+	}
+}
+
+// poll returns the changes since the last poll.
+func (p *poller) poll() []fsnotify.Event {
+	p.mu.Lock()
+	paths := make([]string, 0, len(p.paths))
+	for path := range p.paths {
+		paths = append(paths, path)
+	}
+	p.mu.Unlock()
+
+	var evs []fsnotify.Event
+	for _, path := range paths {
+		now := scanPolled(path)
+		p.mu.Lock()
+		last, ok := p.paths[path]
+		if ok {
+			p.paths[path] = now
+		}
+		p.mu.Unlock()
+		if !ok {
+			continue
+		}
+		for name, e := range now {
+			switch l, ok := last[name]; {
+			case !ok:
+				evs = append(evs, fsnotify.Event{Name: filepath.Join(path, name), Op: fsnotify.Create})
+			case !e.dir && l.fileState != e.fileState:
+				evs = append(evs, fsnotify.Event{Name: filepath.Join(path, name), Op: fsnotify.Write})
+			}
+		}
+		for name := range last {
+			if _, ok := now[name]; !ok {
+				evs = append(evs, fsnotify.Event{Name: filepath.Join(path, name), Op: fsnotify.Remove})
+			}
+		}
+	}
+	return evs
+}
+
+// scanPolled returns the entries of a directory, or the file itself.
+func scanPolled(path string) map[string]polledEntry {
+	m := make(map[string]polledEntry)
+	fi, err := os.Stat(longPath(path))
+	if err != nil {
+		return m
+	}
+	if !fi.IsDir() {
+		m[""] = polledEntry{fileState{fi.Size(), fi.ModTime(), true}, false}
+		return m
+	}
+	ents, err := ioutil.ReadDir(longPath(path))
+	if err != nil {
+		return m
+	}
+	for _, e := range ents {
+		m[normName(e.Name())] = polledEntry{fileState{e.Size(), e.ModTime(), true}, e.IsDir()}
+	}
+	return m
+}
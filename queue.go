@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A queueState describes what Watch is doing: the run in progress,
+// the changes waiting for the next run, and when that is due.
+type queueState struct {
+	Running *queueRun `json:"running,omitempty"`
+	// Queued are the changed files waiting for the next run.
+	Queued []string `json:"queued,omitempty"`
+	// Next is the reason for a run to start when the current one ends.
+	Next string `json:"next,omitempty"`
+	// Debounce is the state of the debounce timer: idle, debouncing
+	// until Due, settling until Due, waiting for the running command,
+	// or paused.
+	Debounce string     `json:"debounce"`
+	Due      *time.Time `json:"due,omitempty"`
+}
+
+// A queueRun is the run in progress.
+type queueRun struct {
+	Reason string    `json:"reason"`
+	Start  time.Time `json:"start"`
+	Files  []string  `json:"files,omitempty"`
+}
+
+var (
+	queueMu sync.Mutex
+	queue   = queueState{Debounce: "idle"}
+)
+
+// setQueue replaces the queue state.
+func setQueue(q queueState) {
+	queueMu.Lock()
+	queue = q
+	queueMu.Unlock()
+}
+
+// currentQueue returns the queue state.
+func currentQueue() queueState {
+	queueMu.Lock()
+	defer queueMu.Unlock()
+	return queue
+}
+
+// text describes the queue state in a few lines.
+func (q queueState) text() string {
+	var b strings.Builder
+	if r := q.Running; r != nil {
+		fmt.Fprintf(&b, "running: %s run for %s", r.Reason, time.Since(r.Start).Round(time.Millisecond))
+		if len(r.Files) > 0 {
+			fmt.Fprintf(&b, " (%s)", strings.Join(r.Files, " "))
+		}
+		b.WriteString("\n")
+	} else {
+		b.WriteString("running: nothing\n")
+	}
+	if q.Next != "" {
+		fmt.Fprintf(&b, "next: %s run when the current one ends\n", q.Next)
+	}
+	fmt.Fprintf(&b, "queued: %d files", len(q.Queued))
+	if len(q.Queued) > 0 {
+		fmt.Fprintf(&b, " (%s)", strings.Join(q.Queued, " "))
+	}
+	b.WriteString("\n")
+	b.WriteString("debounce: " + q.Debounce)
+	if q.Due != nil {
+		if d := time.Until(*q.Due); d > 0 {
+			fmt.Fprintf(&b, ", %s left", d.Round(time.Millisecond))
+		}
+	}
+	b.WriteString("\n")
+	return b.String()
+}
+
+// serveQueue serves the queue state as JSON. Only the page at the root
+// of the same address reads it: there is no CORS header, so that other
+// sites the developer visits cannot read the changed files.
+func serveQueue(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(currentQueue())
+}
+
+// queuePage shows the queue state, refreshed every half second.
+const queuePage = `<!DOCTYPE html>
+<title>Watch</title>
+<pre id="queue"></pre>
+<script>
+function show(q) {
+	var lines = [];
+	lines.push("running: " + (q.running ? q.running.reason + " run since " + new Date(q.running.start).toLocaleTimeString() + (q.running.files ? " (" + q.running.files.join(" ") + ")" : "") : "nothing"));
+	if (q.next) lines.push("next: " + q.next + " run when the current one ends");
+	lines.push("queued: " + (q.queued || []).length + " files" + (q.queued ? " (" + q.queued.join(" ") + ")" : ""));
+	var due = q.due ? new Date(q.due) - Date.now() : 0;
+	lines.push("debounce: " + q.debounce + (due > 0 ? ", " + due + "ms left" : ""));
+	document.getElementById("queue").textContent = lines.join("\n");
+}
+function poll() {
+	fetch("queue").then(function(r) { return r.json(); }).then(show).catch(function() {}).then(function() { setTimeout(poll, 500); });
+}
+poll();
+</script>
+`
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"path/filepath"
+	"time"
+)
+
+var (
+	raceEvery    = flag.Int("race-every", 0, "Add -race to the go command every this many runs, keeping the other runs fast")
+	raceInterval = flag.Duration("race-interval", 0, "Add -race to the go command on the first run after this long since it was last added")
+)
+
+// raceRuns counts the runs since -race was last added, and lastRace is
+// when it was, or the start of the session.
+var (
+	raceRuns int
+	lastRace = time.Now()
+)
+
+// checkRace reports an error if -race cannot be added to the command.
+func checkRace(args []string) error {
+	if *raceEvery <= 0 && *raceInterval <= 0 {
+		return nil
+	}
+	if !isGoBuild(args) {
+		return errors.New("-race-every and -race-interval need a go build, install, run, or test command")
+	}
+	return nil
+}
+
+// isGoBuild reports whether args are a go command that takes -race.
+func isGoBuild(args []string) bool {
+	if len(args) < 2 || filepath.Base(args[0]) != "go" {
+		return false
+	}
+	switch args[1] {
+	case "build", "install", "run", "test":
+		return true
+	}
+	return false
+}
+
+// raceArgs returns the arguments for this run, with -race added after
+// the go command's name when the rotation calls for it.
+func raceArgs(args []string) []string {
+	if !isGoBuild(args) {
+		return args
+	}
+	raceRuns++
+	due := *raceEvery > 0 && raceRuns >= *raceEvery ||
+		*raceInterval > 0 && time.Since(lastRace) >= *raceInterval
+	if !due {
+		return args
+	}
+	raceRuns, lastRace = 0, time.Now()
+	return append([]string{args[0], args[1], "-race"}, args[2:]...)
+}
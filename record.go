@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var recordFile = flag.String("record", "", "Record the session's file events and output, with their timing, to this file, for watch replay")
+
+// A recordEntry is a line of a recording. At is the time since the
+// session started.
+type recordEntry struct {
+	At   time.Duration `json:"at"`
+	Kind string        `json:"kind"` // "start", "event", "output", or "finished"
+	// Args are Watch's arguments for start, and the command's for finished.
+	Args   []string `json:"args,omitempty"`
+	Path   string   `json:"path,omitempty"`
+	Op     string   `json:"op,omitempty"`
+	Output string   `json:"output,omitempty"`
+	Status int      `json:"status,omitempty"`
+}
+
+// A recorder writes the session to a recording as it goes.
+type recorder struct {
+	start time.Time
+
+	mu  sync.Mutex
+	f   *os.File
+	w   *bufio.Writer
+	enc *json.Encoder
+}
+
+// sessionRecorder is the recorder, if the session is recorded.
+var sessionRecorder *recorder
+
+func (r *recorder) record(e recordEntry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e.At = time.Since(r.start)
+	if err := r.enc.Encode(e); err != nil {
+		log.Printf("Failed to record the session: %s", err)
+	}
+}
+
+// event records a file event.
+func (r *recorder) event(c change) {
+	r.record(recordEntry{Kind: "event", Path: c.path, Op: c.op.String()})
+}
+
+// recordAll records the file events, if the session is recorded.
+func recordAll(changes []change) {
+	if sessionRecorder == nil {
+		return
+	}
+	for _, c := range changes {
+		sessionRecorder.event(c)
+	}
+}
+
+func (r *recorder) Write(p []byte) (int, error) {
+	r.record(recordEntry{Kind: "output", Output: string(p)})
+	return len(p), nil
+}
+
+func (r *recorder) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.w.Flush(); err != nil {
+		log.Printf("Failed to record the session: %s", err)
+	}
+	r.f.Close()
+}
+
+// A recordUI is a frontend that also records its output.
+type recordUI struct {
+	ui
+	r *recorder
+}
+
+func (u recordUI) redisplay(f func(io.Writer)) {
+	u.ui.redisplay(func(out io.Writer) { f(io.MultiWriter(out, u.r)) })
+}
+
+func (u recordUI) finished(res runResult) {
+	u.r.record(recordEntry{Kind: "finished", Args: res.args, Status: res.status})
+	u.ui.finished(res)
+}
+
+// startRecording starts recording the session for -record, returning the
+// frontend to write the output through instead.
+func startRecording(u ui) (ui, error) {
+	if *recordFile == "" {
+		return u, nil
+	}
+	f, err := os.Create(*recordFile)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create the recording: %s", err)
+	}
+	w := bufio.NewWriter(f)
+	r := &recorder{start: time.Now(), f: f, w: w, enc: json.NewEncoder(w)}
+	r.record(recordEntry{Kind: "start", Args: os.Args[1:]})
+	sessionRecorder = r
+	atExit(r.close)
+	return recordUI{u, r}, nil
+}
+
+// replayCmd plays a recording back, with its timing:
+//
+//	watch replay [-speed n] [-q] file
+func replayCmd(args []string) {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	speed := fs.Float64("speed", 1, "Play back this many times faster; 0 plays it all at once")
+	quiet := fs.Bool("q", false, "Play back only the output, without the file events and exit statuses")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		log.Fatalln("usage: watch replay [-speed n] [-q] file")
+	}
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer f.Close()
+
+	start := time.Now()
+	dec := json.NewDecoder(f)
+	for {
+		var e recordEntry
+		if err := dec.Decode(&e); err == io.EOF {
+			return
+		} else if err != nil {
+			log.Fatalf("Bad recording: %s", err)
+		}
+		if *speed > 0 {
+			time.Sleep(time.Until(start.Add(time.Duration(float64(e.At) / *speed))))
+		}
+		switch e.Kind {
+		case "output":
+			os.Stdout.WriteString(e.Output)
+		case "start":
+			if !*quiet {
+				fmt.Fprintf(os.Stderr, "# watch %s\n", strings.Join(e.Args, " "))
+			}
+		case "event":
+			if !*quiet {
+				fmt.Fprintf(os.Stderr, "# %s %s at %s\n", e.Op, e.Path, e.At.Round(time.Millisecond))
+			}
+		case "finished":
+			if !*quiet {
+				fmt.Fprintf(os.Stderr, "# %s exited with status %d at %s\n", strings.Join(e.Args, " "), e.Status, e.At.Round(time.Millisecond))
+			}
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// restartWatcher replaces w, which failed, with a new watcher watching
+// the same paths. Paths that are polled stay polled. Only failing to
+// create the new watcher is fatal.
+func restartWatcher(w *fsnotify.Watcher) *fsnotify.Watcher {
+	w.Close()
+	nw, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Fatalf("Failed to restart the watcher: %s", err)
+	}
+	var paths []string
+	for p := range watched {
+		if !polls.polling(p) {
+			paths = append(paths, p)
+		}
+	}
+	sort.Strings(paths)
+	for _, p := range paths {
+		delete(watched, p)
+		watch(nw, p)
+	}
+	debugPrint("Restarted the watcher on %d paths", len(paths))
+	return nw
+}
+
+// sendLost sends changes standing in for events that may have been lost:
+// the directories whose creation was missed, and the watched directories.
+func sendLost(w *fsnotify.Watcher, changes chan<- change) {
+	for _, p := range rescan(w) {
+		explain(p, fsnotify.Create, "queued", "found after events were lost")
+		changes <- change{time: time.Now(), path: p, op: fsnotify.Create}
+	}
+	var roots []string
+	for p := range ignoreRoots {
+		roots = append(roots, p)
+	}
+	sort.Strings(roots)
+	for _, p := range roots {
+		explain(p, fsnotify.Write, "queued", "events in it may have been lost")
+		changes <- change{time: time.Now(), path: p, op: fsnotify.Write}
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+var reloadAddr = flag.String("reload", "", "Serve live reload events to browsers on this address, e.g. localhost:35729")
+
+// A reloadMessage tells browsers which assets changed. If they are all
+// stylesheets, browsers swap them in place instead of reloading the page.
+type reloadMessage struct {
+	Changed []string `json:"changed"`
+	// Assets maps the changed assets to their fingerprinted names, with -assets.
+	Assets map[string]string `json:"assets,omitempty"`
+}
+
+// event returns the type of event for the message: style if only
+// stylesheets changed, otherwise reload.
+func (m reloadMessage) event() string {
+	for _, p := range m.Changed {
+		if strings.ToLower(filepath.Ext(p)) != ".css" {
+			return "reload"
+		}
+	}
+	return "style"
+}
+
+// A reloadServer sends reload messages to browsers as server-sent events
+// on /reload, and serves a script that listens to them on /reload.js.
+type reloadServer struct {
+	mu      sync.Mutex
+	clients map[chan reloadMessage]bool
+}
+
+// reloads is the running reload server, if any.
+var reloads *reloadServer
+
+func startReloadServer() error {
+	l, err := net.Listen("tcp", *reloadAddr)
+	if err != nil {
+		return fmt.Errorf("Failed to listen for reload clients: %s", err)
+	}
+	reloads = &reloadServer{clients: make(map[chan reloadMessage]bool)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/reload", reloads.events)
+	mux.HandleFunc("/reload.js", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/javascript")
+		fmt.Fprintf(w, reloadScript, "//"+r.Host+"/reload")
+	})
+	mux.HandleFunc("/queue", serveQueue)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		io.WriteString(w, queuePage)
+	})
+	debugPrint("Serving reload events on %s", l.Addr())
+	go func() {
+		log.Printf("Reload server failed: %s", http.Serve(l, mux))
+	}()
+	return nil
+}
+
+// reloadScript reloads the page when told to, given the events URL.
+// For style events, it instead points the stylesheet links to the
+// changed files, at their new fingerprinted names if there are any.
+const reloadScript = `(function() {
+	var es = new EventSource(location.protocol + %q);
+	es.addEventListener("reload", function() { location.reload(); });
+	es.addEventListener("style", function(e) {
+		var m = JSON.parse(e.data), assets = m.assets || {};
+		var links = document.querySelectorAll('link[rel="stylesheet"]');
+		m.changed.forEach(function(p) {
+			var base = p.split("/").pop(), dot = base.lastIndexOf(".");
+			var stem = base.slice(0, dot), ext = base.slice(dot);
+			for (var i = 0; i < links.length; i++) {
+				var url = new URL(links[i].href), parts = url.pathname.split("/");
+				var name = parts[parts.length - 1];
+				if (name !== base && !(name.indexOf(stem + ".") === 0 && /^\.[0-9a-f]{8}$/.test(name.slice(stem.length, -ext.length)) && name.slice(-ext.length) === ext)) {
+					continue;
+				}
+				if (assets[p]) {
+					parts[parts.length - 1] = assets[p].split("/").pop();
+					url.pathname = parts.join("/");
+				} else {
+					url.searchParams.set("watch", Date.now());
+				}
+				links[i].href = url.toString();
+			}
+		});
+	});
+})();
+`
+
+func (s *reloadServer) events(w http.ResponseWriter, r *http.Request) {
+	f, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	f.Flush()
+
+	c := make(chan reloadMessage, 16)
+	s.mu.Lock()
+	s.clients[c] = true
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.clients, c)
+		s.mu.Unlock()
+	}()
+
+	for {
+		select {
+		case m := <-c:
+			b, _ := json.Marshal(m)
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", m.event(), b); err != nil {
+				return
+			}
+			f.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// send sends m to every client, skipping those too slow to keep up.
+func (s *reloadServer) send(m reloadMessage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.clients {
+		select {
+		case c <- m:
+		default:
+		}
+	}
+}
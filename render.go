@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	texttemplate "text/template"
+)
+
+var (
+	templateDir  = flag.String("templates", "", "Render the Go templates in this directory to -templates-out before running the command")
+	templateOut  = flag.String("templates-out", "", "The directory that -templates are rendered to; changes in it do not trigger runs")
+	templateData = flag.String("templates-data", "", "A JSON file whose contents are passed to -templates as their data")
+)
+
+// checkTemplateFlags checks that -templates and -templates-out are given together.
+func checkTemplateFlags() error {
+	if (*templateDir == "") != (*templateOut == "") {
+		return fmt.Errorf("-templates and -templates-out must be given together")
+	}
+	return nil
+}
+
+// isTemplateOutput reports whether p is rendered from the templates.
+func isTemplateOutput(p string) bool {
+	return *templateOut != "" && within(p, filepath.Clean(*templateOut))
+}
+
+// needsRender reports whether the templates must be rendered again.
+func needsRender(reason string, changes []change) bool {
+	if *templateDir == "" {
+		return false
+	}
+	if reason == "start" {
+		return true
+	}
+	dir := filepath.Clean(*templateDir)
+	for _, c := range changes {
+		if within(c.path, dir) || (*templateData != "" && c.path == filepath.Clean(*templateData)) {
+			return true
+		}
+	}
+	return false
+}
+
+// renderTemplates renders each template in -templates whose name does not
+// start with an underscore to the same path in -templates-out. Templates
+// starting with an underscore are layouts and partials, which every page
+// can use. HTML files are rendered with html/template, others with
+// text/template. It reports whether all rendered.
+func renderTemplates(out io.Writer) bool {
+	fail := func(err error) bool {
+		io.WriteString(out, "render: "+err.Error()+"\n")
+		return false
+	}
+	var data interface{}
+	if *templateData != "" {
+		b, err := ioutil.ReadFile(*templateData)
+		if err != nil {
+			return fail(err)
+		}
+		if err := json.Unmarshal(b, &data); err != nil {
+			return fail(fmt.Errorf("%s: %s", *templateData, err))
+		}
+	}
+
+	var pages, partials []string
+	err := filepath.Walk(*templateDir, func(p string, fi os.FileInfo, err error) error {
+		switch {
+		case err != nil:
+			return err
+		case !fi.Mode().IsRegular():
+		case strings.HasPrefix(fi.Name(), "_"):
+			partials = append(partials, p)
+		default:
+			pages = append(pages, p)
+		}
+		return nil
+	})
+	if err != nil {
+		return fail(err)
+	}
+
+	n := 0
+	for _, p := range pages {
+		rel, err := filepath.Rel(*templateDir, p)
+		if err != nil {
+			return fail(err)
+		}
+		files := append([]string{p}, partials...)
+		var t interface {
+			Execute(io.Writer, interface{}) error
+		}
+		if ext := strings.ToLower(filepath.Ext(p)); ext == ".html" || ext == ".htm" {
+			t, err = htmltemplate.ParseFiles(files...)
+		} else {
+			t, err = texttemplate.ParseFiles(files...)
+		}
+		if err != nil {
+			return fail(err)
+		}
+		var b strings.Builder
+		if err := t.Execute(&b, data); err != nil {
+			return fail(err)
+		}
+		dst := filepath.Join(*templateOut, rel)
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return fail(err)
+		}
+		if err := writeFileAtomic(dst, []byte(b.String())); err != nil {
+			return fail(err)
+		}
+		n++
+	}
+	fmt.Fprintf(out, "render: rendered %d templates to %s\n", n, *templateOut)
+	return true
+}
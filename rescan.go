@@ -0,0 +1,43 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"sort"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+var rescanInterval = flag.Duration("rescan", 0, "Walk the watched directories this often, such as 30s, to watch directories whose creation was missed in a burst of changes like a large git checkout")
+
+// rescan watches the directories below the watched directories that are
+// not watched but should be, and returns them.
+func rescan(w *fsnotify.Watcher) []string {
+	var missed []string
+	for root := range ignoreRoots {
+		if isUnwatched(root) {
+			continue
+		}
+		wk := newWalker()
+		wk.walk(root, 0, false)
+		lazy := make(map[string]bool)
+		for _, d := range wk.lazy {
+			lazy[d] = true
+		}
+		for _, d := range wk.dirs {
+			if watched[d] {
+				continue
+			}
+			watch(w, d)
+			if lazy[d] {
+				lazyDirs[d] = true
+			}
+			missed = append(missed, d)
+		}
+	}
+	sort.Strings(missed)
+	for _, d := range missed {
+		log.Printf("Watching %s, whose creation was missed", d)
+	}
+	return missed
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	restart     = flag.Bool("r", false, "Restart the command on changes, for long-running processes such as servers")
+	killStale   = flag.Bool("k", false, "Kill the running command as soon as a file changes, and run it again")
+	restartWait = flag.Duration("grace", 5*time.Second, "How long to wait after sending the command SIGTERM, with -r, -k, or on exit, before sending SIGKILL")
+)
+
+// runningCmd is the command being run, if any.
+var (
+	runningMu  sync.Mutex
+	runningCmd *exec.Cmd
+)
+
+func setRunning(cmd *exec.Cmd) {
+	runningMu.Lock()
+	runningCmd = cmd
+	runningMu.Unlock()
+	if *restart {
+		writeChildFile(cmd)
+	}
+}
+
+// A childRecord is the server run with -r, recorded in the project's
+// state directory so that if Watch crashes or is upgraded while it
+// runs, the next Watch can stop it rather than leak a second server.
+type childRecord struct {
+	Pid   int      `json:"pid"`
+	Args  []string `json:"args"`
+	Watch int      `json:"watch"` // the pid of the Watch that started it
+}
+
+// childFile returns the name of the file recording the server.
+func childFile() string {
+	dir, err := os.Getwd()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(projectStateDir(dir), "child.json")
+}
+
+// writeChildFile records the running server, or removes the
+// record when it has exited.
+func writeChildFile(cmd *exec.Cmd) {
+	p := childFile()
+	if p == "" {
+		return
+	}
+	if cmd == nil || cmd.Process == nil {
+		os.Remove(p)
+		return
+	}
+	b, _ := json.Marshal(childRecord{Pid: cmd.Process.Pid, Args: cmd.Args, Watch: os.Getpid()})
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		log.Printf("Failed to record the server: %s", err)
+		return
+	}
+	addOwnFile(p)
+	if err := writeFileAtomic(p, b); err != nil {
+		log.Printf("Failed to record the server: %s", err)
+	}
+}
+
+// replaceOrphan stops the server left running by a previous Watch for
+// the same directory that exited without stopping it, since the new
+// server would fail to listen on the same port. The server is left be
+// while the Watch that recorded it runs, unless that is this one, before
+// an upgrade that did not hand it over, and is only stopped if it still
+// leads its process group, in case its pid has been reused since.
+func replaceOrphan() {
+	p := childFile()
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		return
+	}
+	var c childRecord
+	if json.Unmarshal(b, &c) != nil || c.Pid <= 0 {
+		os.Remove(p)
+		return
+	}
+	if adopted != nil && adopted.Pid == c.Pid {
+		return
+	}
+	if c.Watch != os.Getpid() && (c.Watch <= 0 || syscall.Kill(c.Watch, 0) != syscall.ESRCH) {
+		log.Printf("Another Watch is running %v here; leaving it", c.Args)
+		return
+	}
+	defer os.Remove(p)
+	if pgid, err := syscall.Getpgid(c.Pid); err != nil || !hasSetPGID || pgid != c.Pid {
+		return
+	}
+	log.Printf("Stopping %v (pid %d), left running by a previous Watch", c.Args, c.Pid)
+	syscall.Kill(-c.Pid, syscall.SIGTERM)
+	for deadline := time.Now().Add(*restartWait); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if syscall.Kill(-c.Pid, 0) != nil {
+			return
+		}
+	}
+	syscall.Kill(-c.Pid, syscall.SIGKILL)
+}
+
+// stopRunning terminates the command being run, if any, so that
+// a restarted server is not left behind when Watch exits. Like a
+// restart, it sends SIGKILL if SIGTERM has not worked after -grace.
+func stopRunning() {
+	runningMu.Lock()
+	cmd := runningCmd
+	runningMu.Unlock()
+	if cmd == nil || cmd.Process == nil {
+		return
+	}
+	p := cmd.Process.Pid
+	if hasSetPGID {
+		p = -p
+	}
+	syscall.Kill(p, syscall.SIGTERM)
+	for deadline := time.Now().Add(*restartWait); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if syscall.Kill(p, 0) != nil {
+			return
+		}
+	}
+	syscall.Kill(p, syscall.SIGKILL)
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+var rules []*rule
+
+// rulesRunning counts the rules' commands that are running, and ruleRan
+// is sent to when one finishes, so that -idle-exit waits for them.
+var (
+	rulesRunning int32
+	ruleRan      = make(chan struct{}, 1)
+)
+
+func init() {
+	flag.Var((*ruleList)(&rules), "rule", "Run a command of its own for changes to files matching a glob, as [label:]glob[,debounce]=command, e.g. '*.scss,1s=make css'; those changes no longer run the main command, which is then optional (may be repeated)")
+}
+
+// A rule runs its own command for the changes to the files matching its
+// glob, debounced separately, with its output labeled.
+type rule struct {
+	label string
+	glob  string
+	delay time.Duration // 0 for -d
+	args  []string
+
+	changes chan change
+}
+
+type ruleList []*rule
+
+func (l *ruleList) String() string {
+	var s []string
+	for _, r := range *l {
+		s = append(s, r.label+":"+r.glob+"="+strings.Join(r.args, " "))
+	}
+	return strings.Join(s, ",")
+}
+
+func (l *ruleList) Set(s string) error {
+	i := strings.IndexByte(s, '=')
+	if i <= 0 {
+		return fmt.Errorf("%q is not of the form [label:]glob[,debounce]=command", s)
+	}
+	r := &rule{glob: s[:i], args: strings.Fields(s[i+1:]), changes: make(chan change, 256)}
+	if len(r.args) == 0 {
+		return fmt.Errorf("%q has no command", s)
+	}
+	if j := strings.IndexByte(r.glob, ':'); j >= 0 {
+		r.label, r.glob = r.glob[:j], r.glob[j+1:]
+	}
+	if j := strings.LastIndexByte(r.glob, ','); j >= 0 {
+		d, err := time.ParseDuration(r.glob[j+1:])
+		if err != nil {
+			return fmt.Errorf("bad debounce in %q: %s", s, err)
+		}
+		r.glob, r.delay = r.glob[:j], d
+	}
+	if _, err := filepath.Match(r.glob, ""); err != nil {
+		return fmt.Errorf("bad glob in %q: %s", s, err)
+	}
+	if r.label == "" {
+		r.label = filepath.Base(r.args[0])
+	}
+	*l = append(*l, r)
+	return nil
+}
+
+// ruleFor returns the first rule whose glob matches p, or nil.
+func ruleFor(p string) *rule {
+	for _, r := range rules {
+		if matchGlob(r.glob, p) {
+			return r
+		}
+	}
+	return nil
+}
+
+// startRules starts running the rules: each once, then on their changes.
+// It returns a function that stops their commands and waits for them.
+func startRules(ctx context.Context, ui ui) (stop func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	for _, r := range rules {
+		wg.Add(1)
+		go func(r *rule) {
+			defer wg.Done()
+			r.loop(ctx, ui)
+		}(r)
+	}
+	return func() {
+		cancel()
+		wg.Wait()
+	}
+}
+
+// debounce returns the rule's debounce delay, -d by default.
+func (r *rule) debounce() time.Duration {
+	if r.delay != 0 {
+		return r.delay
+	}
+	return defaultDelay()
+}
+
+// loop runs the rule's command on start and after its changes have
+// stopped coming for its debounce delay. Changes made during a run
+// are run for once it ends.
+func (r *rule) loop(ctx context.Context, ui ui) {
+	timer := time.NewTimer(0)
+	done := make(chan struct{})
+	var (
+		pending []change
+		running bool
+		due     bool // whether to run once the running command ends
+		reason  = "start"
+	)
+	for {
+		select {
+		case <-ctx.Done():
+			if running {
+				<-done
+			}
+			return
+
+		case c := <-r.changes:
+			pending = append(pending, c)
+			timer.Reset(r.debounce())
+
+		case <-timer.C:
+			if running {
+				due = true
+				continue
+			}
+			running = true
+			atomic.AddInt32(&rulesRunning, 1)
+			go func(reason string, changes []change) {
+				r.run(ctx, ui, reason, changes)
+				atomic.AddInt32(&rulesRunning, -1)
+				select {
+				case ruleRan <- struct{}{}:
+				default:
+				}
+				done <- struct{}{}
+			}(reason, pending)
+			pending, reason = nil, "change"
+
+		case <-done:
+			running = false
+			if due || len(pending) > 0 {
+				due = false
+				timer.Reset(0)
+			}
+		}
+	}
+}
+
+// run runs the rule's command for the changes, labeling its output.
+func (r *rule) run(ctx context.Context, ui ui, reason string, changes []change) {
+	if *confirmRuns && !confirmRule(ctx, r.label, changes) {
+		explainAll(changes, "declined", "the run was not confirmed")
+		return
+	}
+	var list string
+	if needsList(r.args) {
+		var err error
+		if list, err = writeList(changes); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to write the list of changed files: %s\n", err)
+		}
+		defer os.Remove(list)
+	}
+	res := runResult{args: expandArgs(r.args, changes, list), reason: reason, changes: changes, start: time.Now(), status: -1, rule: r.label}
+	reportStarted(res)
+	ui.redisplay(func(out io.Writer) {
+		mw := prefixedOutput(out, r.label)
+		defer mw.Flush()
+		io.WriteString(mw, mw.status(strings.Join(res.args, " "))+"\n")
+		cmd, err := command(child, res.args)
+		if err != nil {
+			io.WriteString(mw, mw.status("fatal: "+err.Error())+"\n")
+			return
+		}
+		if cmd.Env == nil {
+			cmd.Env = os.Environ()
+		}
+		cmd.Env = append(cmd.Env, runEnv(res)...)
+		cmd.Stdout, cmd.Stderr = mw, mw
+		setPGID(cmd)
+		if err := cmd.Start(); err != nil {
+			io.WriteString(mw, mw.status("fatal: "+err.Error())+"\n")
+			return
+		}
+		if err := waitCommand(ctx, cmd); err != nil {
+			io.WriteString(mw, mw.status(err.Error())+"\n")
+		}
+		res.status = cmd.ProcessState.ExitCode()
+	})
+	res.end = time.Now()
+	reportFinished(res)
+}
+
+// waitCommand waits for a rule's or a step's command to exit. When ctx
+// is canceled, its process group gets SIGTERM, then SIGKILL after -grace.
+func waitCommand(ctx context.Context, cmd *exec.Cmd) error {
+	errc := make(chan error, 1)
+	go func() { errc <- cmd.Wait() }()
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+	syscall.Kill(pgid(cmd), syscall.SIGTERM)
+	select {
+	case err := <-errc:
+		return err
+	case <-time.After(*restartWait):
+	}
+	syscall.Kill(pgid(cmd), syscall.SIGKILL)
+	return <-errc
+}
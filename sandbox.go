@@ -0,0 +1,53 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+)
+
+var (
+	unshare     = flag.Bool("unshare", false, "Run the command in new mount and PID namespaces, with its own /proc and /tmp (Linux only)")
+	readOnlyDir = flag.Bool("ro", false, "Run the command with the working directory mounted read-only, so that it cannot change the watched files (Linux only)")
+	noNetwork   = flag.Bool("no-network", false, "Run the command in a new network namespace with only a loopback interface (Linux only)")
+	sandbox     = flag.Bool("sandbox", false, "Restrict the command's file system access to the working directory, the temporary directory, system directories, and the -sandbox-ro and -sandbox-rw paths (Linux only)")
+	sandboxRO   stringList
+	sandboxRW   stringList
+)
+
+func init() {
+	flag.Var(&sandboxRO, "sandbox-ro", "Allow the sandboxed command to read this path (may be repeated)")
+	flag.Var(&sandboxRW, "sandbox-rw", "Allow the sandboxed command to read and write this path (may be repeated)")
+}
+
+// sandboxSystemPaths are readable by every sandboxed command,
+// so that it can find its executable, libraries, and configuration.
+var sandboxSystemPaths = []string{"/bin", "/sbin", "/usr", "/lib", "/lib32", "/lib64", "/etc", "/opt", "/proc", "/sys"}
+
+// sandboxPaths returns the paths a sandboxed command may read, and may
+// read and write. Paths that do not exist are left out.
+func sandboxPaths() (ro, rw []string, err error) {
+	wd, err := os.Getwd()
+	if err != nil {
+		return nil, nil, err
+	}
+	exists := func(ps []string) []string {
+		var e []string
+		for _, p := range ps {
+			if _, err := os.Stat(p); err == nil {
+				e = append(e, p)
+			}
+		}
+		return e
+	}
+	abs := func(ps []string) []string {
+		var a []string
+		for _, p := range ps {
+			a = append(a, absPath(filepath.Clean(p)))
+		}
+		return a
+	}
+	ro = exists(append(sandboxSystemPaths, abs(sandboxRO)...))
+	rw = exists(append([]string{wd, os.TempDir(), "/dev"}, abs(sandboxRW)...))
+	return ro, rw, nil
+}
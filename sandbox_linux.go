@@ -0,0 +1,108 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// Landlock system calls and constants, from linux/landlock.h.
+const (
+	sysLandlockCreateRuleset = 444
+	sysLandlockAddRule       = 445
+	sysLandlockRestrictSelf  = 446
+
+	landlockCreateRulesetVersion = 1 << 0
+	landlockRulePathBeneath      = 1
+
+	landlockAccessExecute    = 1 << 0
+	landlockAccessWriteFile  = 1 << 1
+	landlockAccessReadFile   = 1 << 2
+	landlockAccessReadDir    = 1 << 3
+	landlockAccessRemoveDir  = 1 << 4
+	landlockAccessRemoveFile = 1 << 5
+	landlockAccessMakeChar   = 1 << 6
+	landlockAccessMakeDir    = 1 << 7
+	landlockAccessMakeReg    = 1 << 8
+	landlockAccessMakeSock   = 1 << 9
+	landlockAccessMakeFifo   = 1 << 10
+	landlockAccessMakeBlock  = 1 << 11
+	landlockAccessMakeSym    = 1 << 12
+
+	// landlockAccessAll holds the access rights of Landlock ABI version 1.
+	landlockAccessAll = 1<<13 - 1
+	landlockAccessRO  = landlockAccessExecute | landlockAccessReadFile | landlockAccessReadDir
+	// landlockAccessFile holds the access rights that apply to files, not directories.
+	landlockAccessFile = landlockAccessExecute | landlockAccessWriteFile | landlockAccessReadFile
+
+	prSetNoNewPrivs = 38
+	oPath           = 0x200000
+)
+
+// restrictFS uses Landlock to restrict the calling thread, and the
+// programs it executes, to reading ro and reading and writing rw.
+func restrictFS(ro, rw []string) error {
+	v, _, errno := syscall.Syscall(sysLandlockCreateRuleset, 0, 0, landlockCreateRulesetVersion)
+	if errno != 0 {
+		return os.NewSyscallError("landlock_create_ruleset", errno)
+	}
+	debugPrint("Landlock ABI version %d", v)
+
+	attr := uint64(landlockAccessAll)
+	fd, _, errno := syscall.Syscall(sysLandlockCreateRuleset, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr), 0)
+	if errno != 0 {
+		return os.NewSyscallError("landlock_create_ruleset", errno)
+	}
+	defer syscall.Close(int(fd))
+
+	for _, p := range ro {
+		if err := landlockAllow(int(fd), p, landlockAccessRO); err != nil {
+			return err
+		}
+	}
+	for _, p := range rw {
+		if err := landlockAllow(int(fd), p, landlockAccessAll); err != nil {
+			return err
+		}
+	}
+
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0); errno != 0 {
+		return os.NewSyscallError("prctl", errno)
+	}
+	if _, _, errno := syscall.Syscall(sysLandlockRestrictSelf, fd, 0, 0); errno != 0 {
+		return os.NewSyscallError("landlock_restrict_self", errno)
+	}
+	return nil
+}
+
+// landlockAllow adds a rule to the ruleset allowing access beneath p.
+func landlockAllow(ruleset int, p string, access uint64) error {
+	fd, err := syscall.Open(p, oPath|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return &os.PathError{Op: "open", Path: p, Err: err}
+	}
+	defer syscall.Close(fd)
+
+	var st syscall.Stat_t
+	if err := syscall.Fstat(fd, &st); err != nil {
+		return &os.PathError{Op: "stat", Path: p, Err: err}
+	}
+	if st.Mode&syscall.S_IFMT != syscall.S_IFDIR {
+		access &= landlockAccessFile
+	}
+
+	// The kernel's struct landlock_path_beneath_attr is packed, but
+	// it only reads the first 12 bytes, which have the same layout.
+	attr := struct {
+		allowedAccess uint64
+		parentFd      int32
+	}{access, int32(fd)}
+	_, _, errno := syscall.Syscall6(sysLandlockAddRule, uintptr(ruleset), landlockRulePathBeneath, uintptr(unsafe.Pointer(&attr)), 0, 0, 0)
+	if errno != 0 {
+		return &os.PathError{Op: "landlock_add_rule", Path: p, Err: errno}
+	}
+	return nil
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "errors"
+
+func restrictFS(ro, rw []string) error {
+	return errors.New("sandboxing is only supported on Linux")
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// stateDir returns the directory in which Watch keeps its state,
+// following the XDG base directory specification, which has a relative
+// $XDG_STATE_HOME ignored. Without $HOME, it is relative too, and
+// callers that would create it must check.
+func stateDir() string {
+	if d := os.Getenv("XDG_STATE_HOME"); filepath.IsAbs(d) {
+		return filepath.Join(d, "watch")
+	}
+	return filepath.Join(os.Getenv("HOME"), ".local", "state", "watch")
+}
+
+// projectStateDir returns the state directory for a Watch
+// session running in the absolute directory dir.
+func projectStateDir(dir string) string {
+	return filepath.Join(stateDir(), "dirs", dir)
+}
+
+// A sessionState is the status of the session running in a directory,
+// as recorded in its state directory.
+type sessionState struct {
+	runStatus
+	Dir string `json:"dir"`
+	Pid int    `json:"pid"`
+}
+
+// A sessionStatus records the status of each run in the
+// session's state directory: status.json for the status subcommand,
+// and prompt, holding just ✔, ✘, or …, for shell prompts to read.
+type sessionStatus struct {
+	sd  string
+	dir string
+}
+
+// newSessionStatus returns a sessionStatus, or nil if the state
+// directory cannot be used, since the status is only a convenience.
+func newSessionStatus() (reporter, error) {
+	dir, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+	sd := projectStateDir(dir)
+	if !filepath.IsAbs(sd) {
+		log.Printf("Not recording the status: the state directory %s is relative; set $HOME or $XDG_STATE_HOME", stateDir())
+		return nil, nil
+	}
+	if err := os.MkdirAll(sd, 0755); err != nil {
+		log.Printf("Not recording the status: failed to create the state directory: %s", err)
+		return nil, nil
+	}
+	s := &sessionStatus{sd: sd, dir: dir}
+	addOwnFile(s.statusPath())
+	addOwnFile(s.promptPath())
+	atExit(s.remove)
+	return s, nil
+}
+
+func (s *sessionStatus) statusPath() string { return filepath.Join(s.sd, "status.json") }
+
+func (s *sessionStatus) promptPath() string { return filepath.Join(s.sd, "prompt") }
+
+func (s *sessionStatus) started(r runResult) {
+	s.write(runStatus{Command: strings.Join(r.args, " "), State: "running", Time: r.start})
+}
+
+func (s *sessionStatus) finished(r runResult) { s.write(newRunStatus(r)) }
+
+func (s *sessionStatus) write(st runStatus) {
+	b, err := json.Marshal(sessionState{runStatus: st, Dir: s.dir, Pid: os.Getpid()})
+	if err != nil {
+		log.Printf("Failed to encode session status: %s", err)
+		return
+	}
+	if err := writeFileAtomic(s.statusPath(), append(b, '\n')); err != nil {
+		log.Printf("Failed to write session status: %s", err)
+	}
+	if err := writeFileAtomic(s.promptPath(), []byte(st.symbol()+"\n")); err != nil {
+		log.Printf("Failed to write prompt status: %s", err)
+	}
+}
+
+// remove removes the session's status files,
+// so that they are never left behind by an exited session.
+func (s *sessionStatus) remove() {
+	os.Remove(s.statusPath())
+	os.Remove(s.promptPath())
+}
+
+// findSession returns the state of the live session running in dir or
+// the nearest of its parents, and whether there was one.
+func findSession(dir string) (sessionState, bool) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return sessionState{}, false
+	}
+	for {
+		var st sessionState
+		b, err := ioutil.ReadFile(filepath.Join(projectStateDir(dir), "status.json"))
+		if err == nil && json.Unmarshal(b, &st) == nil && syscall.Kill(st.Pid, 0) == nil {
+			return st, true
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return sessionState{}, false
+		}
+		dir = parent
+	}
+}
+
+// tmux returns the status formatted for tmux's status-right.
+func (st sessionState) tmux() string {
+	color := map[string]string{"pass": "green", "fail": "red"}[st.State]
+	if color == "" {
+		color = "yellow"
+	}
+	return fmt.Sprintf("#[fg=%s]%s#[default] %s", color, st.symbol(), filepath.Base(st.Dir))
+}
+
+// statusCmd prints the status of the session for a directory.
+// It prints nothing if there is no live session.
+func statusCmd(args []string) {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	tmux := fs.Bool("tmux", false, "Format the status for tmux's status-right")
+	fs.Parse(args)
+
+	dir := "."
+	if fs.NArg() > 0 {
+		dir = fs.Arg(0)
+	}
+	st, ok := findSession(dir)
+	switch {
+	case !ok:
+		return
+	case *tmux:
+		fmt.Println(st.tmux())
+	default:
+		fmt.Printf("%s %s\n", filepath.Base(st.Dir), st.text())
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"time"
+)
+
+var settleTime = flag.Duration("settle", 0, "Before running, wait until changed files have not changed size or modification time for this long")
+
+// A fileState is what is compared to tell whether a file has settled.
+type fileState struct {
+	size    int64
+	modTime time.Time
+	exists  bool
+}
+
+// snapshot returns the states of the files of changes.
+func snapshot(changes []change) map[string]fileState {
+	m := make(map[string]fileState)
+	for _, c := range changes {
+		var st fileState
+		if fi, err := os.Stat(c.path); err == nil {
+			st = fileState{fi.Size(), fi.ModTime(), true}
+		}
+		m[c.path] = st
+	}
+	return m
+}
+
+// A settler tells whether the pending changes have settled, by comparing
+// the files to how they were when it was last asked.
+type settler struct {
+	last map[string]fileState
+}
+
+// settled reports whether the files of changes are as they were on the
+// last call. If not, it should be asked again after -settle.
+func (s *settler) settled(changes []change) bool {
+	now := snapshot(changes)
+	ok := s.last != nil && len(now) == len(s.last)
+	for p, st := range now {
+		if !ok {
+			break
+		}
+		ok = s.last[p] == st
+	}
+	s.last = now
+	if ok {
+		s.last = nil
+	}
+	return ok
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+var (
+	shareAddr  = flag.String("share", "", "Let others follow the output, read-only, over HTTP on this address, e.g. :7070, with the token from -share-token")
+	shareToken = flag.String("share-token", "", "The token viewers of -share must give (default: a random token, logged at start)")
+	shareCert  = flag.String("share-cert", "", "With -share, serve HTTPS with this certificate file")
+	shareKey   = flag.String("share-key", "", "With -share, serve HTTPS with this key file")
+)
+
+// shareBacklog is how much of the latest output a viewer is sent on
+// attaching, so that they see the current run's.
+const shareBacklog = 64 << 10
+
+// A shareServer sends the output to viewers as it is written.
+type shareServer struct {
+	token string
+
+	mu      sync.Mutex
+	backlog []byte
+	viewers map[chan []byte]bool
+}
+
+// A shareUI is a frontend that also sends its output to viewers.
+type shareUI struct {
+	ui
+	s *shareServer
+}
+
+func (u shareUI) redisplay(f func(io.Writer)) {
+	u.ui.redisplay(func(out io.Writer) { f(io.MultiWriter(out, u.s)) })
+}
+
+// startShare starts serving the output written through u to viewers
+// for -share, returning the frontend to write it through instead.
+func startShare(u ui) (ui, error) {
+	if *shareAddr == "" {
+		return u, nil
+	}
+	if (*shareCert == "") != (*shareKey == "") {
+		return nil, fmt.Errorf("-share-cert and -share-key must be given together")
+	}
+	s := &shareServer{token: *shareToken, viewers: make(map[chan []byte]bool)}
+	if s.token == "" {
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		s.token = hex.EncodeToString(b)
+	}
+	l, err := net.Listen("tcp", *shareAddr)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to listen for viewers: %s", err)
+	}
+	scheme := "http"
+	if *shareCert != "" {
+		scheme = "https"
+	}
+	log.Printf("Sharing the output on %s://%s/ with token %s: watch attach -token %s %s://%s/",
+		scheme, l.Addr(), s.token, s.token, scheme, l.Addr())
+	go func() {
+		var err error
+		if *shareCert != "" {
+			err = http.ServeTLS(l, s, *shareCert, *shareKey)
+		} else {
+			err = http.Serve(l, s)
+		}
+		log.Printf("Share server failed: %s", err)
+	}()
+	return shareUI{u, s}, nil
+}
+
+func (s *shareServer) Write(p []byte) (int, error) {
+	b := append([]byte(nil), p...)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.backlog = append(s.backlog, b...)
+	if n := len(s.backlog) - shareBacklog; n > 0 {
+		s.backlog = s.backlog[n:]
+	}
+	for c := range s.viewers {
+		select {
+		case c <- b:
+		default:
+			// Too slow to keep up: drop the viewer rather than hold up the command.
+			delete(s.viewers, c)
+			close(c)
+		}
+	}
+	return len(p), nil
+}
+
+// authorized reports whether the request carries the token, as a bearer
+// token or a token parameter.
+func (s *shareServer) authorized(r *http.Request) bool {
+	tok := r.URL.Query().Get("token")
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		tok = h[len("Bearer "):]
+	}
+	return subtle.ConstantTimeCompare([]byte(tok), []byte(s.token)) == 1
+}
+
+// ServeHTTP streams the backlog and then the output as it is written,
+// as plain text, until the viewer goes away.
+func (s *shareServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "The output is read-only", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.authorized(r) {
+		http.Error(w, "A valid token is required", http.StatusUnauthorized)
+		return
+	}
+	fl, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	c := make(chan []byte, 256)
+	s.mu.Lock()
+	backlog := append([]byte(nil), s.backlog...)
+	s.viewers[c] = true
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.viewers, c)
+		s.mu.Unlock()
+	}()
+	debugPrint("Viewer attached from %s", r.RemoteAddr)
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Write(backlog)
+	fl.Flush()
+	for {
+		select {
+		case b, ok := <-c:
+			if !ok {
+				return
+			}
+			if _, err := w.Write(b); err != nil {
+				return
+			}
+			fl.Flush()
+		case <-r.Context().Done():
+			debugPrint("Viewer from %s went away", r.RemoteAddr)
+			return
+		}
+	}
+}
+
+// attachCmd follows the output of a session shared with -share:
+//
+//	watch attach -token token url
+func attachCmd(args []string) {
+	fs := flag.NewFlagSet("attach", flag.ExitOnError)
+	token := fs.String("token", os.Getenv("WATCH_SHARE_TOKEN"), "The session's token (default: $WATCH_SHARE_TOKEN)")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		log.Fatalln("usage: watch attach -token token url")
+	}
+	req, err := http.NewRequest("GET", fs.Arg(0), nil)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+*token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		log.Fatalf("Failed to attach: %s", resp.Status)
+	}
+	io.Copy(os.Stdout, resp.Body)
+}
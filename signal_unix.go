@@ -0,0 +1,15 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// triggerSignal reruns the command, and pauseSignal toggles pausing.
+var (
+	triggerSignal os.Signal = syscall.SIGUSR1
+	pauseSignal   os.Signal = syscall.SIGUSR2
+)
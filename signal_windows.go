@@ -0,0 +1,10 @@
+//go:build windows
+// +build windows
+
+package main
+
+import "os"
+
+// triggerSignal reruns the command, and pauseSignal toggles pausing.
+// Windows has no signals to spare.
+var triggerSignal, pauseSignal os.Signal
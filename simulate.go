@@ -0,0 +1,132 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// simulateWindow is how long the decisions about a simulated event are
+// collected for, unless it is excluded or ignored first.
+const simulateWindow = time.Second
+
+// simulated receives the events injected with watch simulate, which are
+// handled like the watcher's by the goroutine that reads them.
+var simulated = make(chan fsnotify.Event)
+
+// simulations are the channels that the decisions about the paths of
+// simulated events are sent to while they are collected, by path.
+var (
+	simulationsMu sync.Mutex
+	simulations   = make(map[string]chan explanation)
+)
+
+// simulateOps are the ops of simulated events, by name.
+var simulateOps = map[string]fsnotify.Op{
+	"create": fsnotify.Create,
+	"write":  fsnotify.Write,
+	"remove": fsnotify.Remove,
+	"rename": fsnotify.Rename,
+	"chmod":  fsnotify.Chmod,
+}
+
+// simulate injects an event for p, which need not exist, and returns
+// the decisions made about it within simulateWindow.
+func simulate(p, opName string) ([]explanation, error) {
+	op, ok := simulateOps[opName]
+	if !ok {
+		return nil, fmt.Errorf("unknown op %q: choose from create, write, remove, rename, or chmod", opName)
+	}
+	p = watchedName(p)
+	c := make(chan explanation, 16)
+	simulationsMu.Lock()
+	if _, ok := simulations[p]; ok {
+		simulationsMu.Unlock()
+		return nil, fmt.Errorf("%s is already being simulated", p)
+	}
+	simulations[p] = c
+	simulationsMu.Unlock()
+	defer func() {
+		simulationsMu.Lock()
+		delete(simulations, p)
+		simulationsMu.Unlock()
+	}()
+
+	simulated <- fsnotify.Event{Name: p, Op: op}
+	var decisions []explanation
+	timeout := time.After(simulateWindow)
+	for {
+		select {
+		case e := <-c:
+			decisions = append(decisions, e)
+			if e.Decision == "excluded" || e.Decision == "ignored" {
+				return decisions, nil
+			}
+		case <-timeout:
+			return decisions, nil
+		}
+	}
+}
+
+// simulating reports whether an event for p is being simulated.
+func simulating(p string) bool {
+	simulationsMu.Lock()
+	defer simulationsMu.Unlock()
+	_, ok := simulations[p]
+	return ok
+}
+
+// sendSimulation sends the decision to the simulation of its path, if any.
+func sendSimulation(e explanation) {
+	simulationsMu.Lock()
+	defer simulationsMu.Unlock()
+	if c, ok := simulations[e.Path]; ok {
+		select {
+		case c <- e:
+		default:
+		}
+	}
+}
+
+// simulateCmd injects an event into the running session for the
+// working directory, and prints what was decided about it:
+//
+//	watch simulate [-socket path] path [op]
+func simulateCmd(args []string) {
+	fs := flag.NewFlagSet("simulate", flag.ExitOnError)
+	sock := fs.String("socket", "", "The control socket (default: that of the session for the working directory)")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s simulate [-socket path] path [create|write|remove|rename|chmod]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() < 1 || fs.NArg() > 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	p, err := filepath.Abs(fs.Arg(0))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	req := ctlRequest{Method: "simulate", Version: ctlVersion, Path: p, Op: "write"}
+	if fs.NArg() == 2 {
+		req.Op = strings.ToLower(fs.Arg(1))
+	}
+	m, err := sendCtl(*sock, req)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if len(m.Decisions) == 0 {
+		fmt.Println("nothing was decided: the event was dropped without explanation")
+	}
+	for _, e := range m.Decisions {
+		fmt.Println(e.text())
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var (
+	statusPath   = flag.String("status", "", "Write the current build status to this file for status bars")
+	statusFormat = flag.String("status-format", "text", "The status file format: text, i3blocks, or waybar")
+)
+
+// A statusFile is rewritten with a one-line summary
+// whenever a run starts or finishes.
+type statusFile struct {
+	path   string
+	format func(st runStatus) string
+}
+
+// A runStatus is the state of the most recent run.
+type runStatus struct {
+	Command  string        `json:"command"`
+	State    string        `json:"state"` // "running", "pass", or "fail"
+	Time     time.Time     `json:"time"`
+	Duration time.Duration `json:"duration"`
+}
+
+func (st runStatus) symbol() string {
+	switch st.State {
+	case "pass":
+		return "✔"
+	case "fail":
+		return "✘"
+	default:
+		return "…"
+	}
+}
+
+func (st runStatus) text() string {
+	if st.State == "running" {
+		return st.symbol() + " running"
+	}
+	return fmt.Sprintf("%s %s %s", st.symbol(), st.State, st.Duration)
+}
+
+func newRunStatus(r runResult) runStatus {
+	st := runStatus{
+		Command:  strings.Join(r.args, " "),
+		State:    "pass",
+		Time:     r.end,
+		Duration: r.end.Sub(r.start).Round(time.Millisecond),
+	}
+	if r.status != 0 {
+		st.State = "fail"
+	}
+	return st
+}
+
+var statusFormats = map[string]func(runStatus) string{
+	"text": func(st runStatus) string { return st.text() + "\n" },
+
+	// i3blocks reads the full text, short text, and color from successive lines.
+	"i3blocks": func(st runStatus) string {
+		color := map[string]string{"pass": "#00FF00", "fail": "#FF0000"}[st.State]
+		return st.text() + "\n" + st.symbol() + "\n" + color + "\n"
+	},
+
+	// waybar reads a JSON object with the text, tooltip, and CSS class.
+	"waybar": func(st runStatus) string {
+		b, _ := json.Marshal(struct {
+			Text    string `json:"text"`
+			Tooltip string `json:"tooltip"`
+			Class   string `json:"class"`
+			Alt     string `json:"alt"`
+		}{st.text(), st.Command + ": " + st.text(), st.State, st.State})
+		return string(b) + "\n"
+	},
+}
+
+// newStatusFile returns a statusFile for the -status flags,
+// or nil if no status file was requested.
+func newStatusFile() (reporter, error) {
+	if *statusPath == "" {
+		return nil, nil
+	}
+	f, ok := statusFormats[*statusFormat]
+	if !ok {
+		return nil, fmt.Errorf("Unknown status format: %s", *statusFormat)
+	}
+	addOwnFile(*statusPath)
+	return &statusFile{path: *statusPath, format: f}, nil
+}
+
+func (s *statusFile) started(r runResult) {
+	s.write(runStatus{Command: strings.Join(r.args, " "), State: "running", Time: r.start})
+}
+
+func (s *statusFile) finished(r runResult) { s.write(newRunStatus(r)) }
+
+func (s *statusFile) write(st runStatus) {
+	if err := writeFileAtomic(s.path, []byte(s.format(st))); err != nil {
+		log.Printf("Failed to write status file: %s", err)
+	}
+}
+
+// ownFiles holds the absolute paths of files written by Watch itself.
+// Changes to them, and to the temporary files used to write them,
+// never trigger a rerun. It must only be modified before watching starts.
+var ownFiles = make(map[string]bool)
+
+func addOwnFile(p string) {
+	if a, err := filepath.Abs(p); err == nil {
+		ownFiles[a] = true
+	}
+}
+
+func isOwnFile(p string) bool {
+	a, err := filepath.Abs(p)
+	if err != nil {
+		return false
+	}
+	if ownFiles[a] {
+		return true
+	}
+	dir, base := filepath.Split(a)
+	for f := range ownFiles {
+		if d, b := filepath.Split(f); d == dir && strings.HasPrefix(base, "."+b) {
+			return true
+		}
+	}
+	return false
+}
+
+// writeFileAtomic writes data to a temporary file beside p and renames
+// it into place, so that readers never see a partially written file.
+// The file keeps the mode of the one it replaces, or is made 0644, as
+// with ioutil.WriteFile, for other users such as a static file server.
+func writeFileAtomic(p string, data []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(p), "."+filepath.Base(p))
+	if err != nil {
+		return err
+	}
+	mode := os.FileMode(0644)
+	if fi, err := os.Stat(p); err == nil {
+		mode = fi.Mode().Perm()
+	}
+	if err := f.Chmod(mode); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), p)
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"log"
+	"os"
+)
+
+var triggerStdin = flag.Bool("trigger-stdin", false, "Run the command for each line read from standard input, passing it in $WATCH_LINE")
+
+// readStdin sends each line of standard input to lines.
+func readStdin(lines chan<- string) {
+	sc := bufio.NewScanner(os.Stdin)
+	for sc.Scan() {
+		lines <- sc.Text()
+	}
+	if err := sc.Err(); err != nil {
+		log.Printf("Failed to read standard input: %s", err)
+	}
+	debugPrint("End of standard input")
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"log"
+	"os/exec"
+	"path/filepath"
+	"sync"
+)
+
+var (
+	streamPaths = flag.Bool("stream", false, "Keep one instance of the command running and write the changed paths to its standard input, one per line")
+	streamNul   = flag.Bool("0", false, "With -stream, end each path with a NUL byte instead of a newline")
+)
+
+// A streamer keeps the command running for -stream, restarting
+// it on the next change after it exits.
+type streamer struct {
+	ui ui
+
+	mu    sync.Mutex
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+}
+
+// send writes the changed files to the command, starting it if needed.
+func (s *streamer) send(changes []change) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cmd == nil {
+		if err := s.start(); err != nil {
+			log.Printf("Failed to start %s: %s", cmdArgs[0], err)
+			return
+		}
+	}
+	end := "\n"
+	if *streamNul {
+		end = "\x00"
+	}
+	for _, p := range (runResult{changes: changes}).files() {
+		if _, err := io.WriteString(s.stdin, p+end); err != nil {
+			log.Printf("Failed to write to %s: %s", cmdArgs[0], err)
+			return
+		}
+	}
+}
+
+// start starts the command, its output going through the frontend
+// until it exits. It must be called with s.mu held.
+func (s *streamer) start() error {
+	cmd, err := command(child, cmdArgs)
+	if err != nil {
+		return err
+	}
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	started := make(chan error, 1)
+	go s.ui.redisplay(func(out io.Writer) {
+		mw := jobOutput(out, filepath.Base(cmdArgs[0]))
+		defer mw.Flush()
+		cmd.Stdout, cmd.Stderr = mw, mw
+		if err := cmd.Start(); err != nil {
+			started <- err
+			return
+		}
+		started <- nil
+		s.wait(cmd)
+	})
+	if err := <-started; err != nil {
+		return err
+	}
+	debugPrint("Started %s", cmdArgs[0])
+	s.cmd, s.stdin = cmd, stdin
+	return nil
+}
+
+func (s *streamer) wait(cmd *exec.Cmd) {
+	err := cmd.Wait()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cmd == cmd {
+		s.cmd, s.stdin = nil, nil
+	}
+	if err != nil {
+		log.Printf("%s exited: %s", cmdArgs[0], err)
+	} else {
+		log.Printf("%s exited", cmdArgs[0])
+	}
+}
+
+// stop closes the command's input and lets it finish.
+func (s *streamer) stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stdin != nil {
+		s.stdin.Close()
+	}
+}
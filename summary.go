@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+// A jobResult is the outcome of one of the jobs run for a change: the
+// migrations, templates, generator, and the command itself.
+type jobResult struct {
+	name     string
+	status   string
+	duration time.Duration
+}
+
+// commandJob returns the result of the command's run as a job.
+func commandJob(r runResult) jobResult {
+	status := "ok"
+	switch {
+	case r.status == -1:
+		status = "failed"
+	case r.status != 0:
+		status = "exit status " + strconv.Itoa(r.status)
+	}
+	return jobResult{filepath.Base(r.args[0]), status, r.end.Sub(r.start)}
+}
+
+// printSummary prints a table of the jobs, if more than one ran,
+// so that failures need not be looked for in their output.
+func printSummary(out io.Writer, jobs []jobResult) {
+	if len(jobs) < 2 {
+		return
+	}
+	tw := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "JOB\tSTATUS\tDURATION")
+	for _, j := range jobs {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", j.name, j.status, j.duration.Round(time.Millisecond))
+	}
+	tw.Flush()
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+var uiName = flag.String("ui", "plain", "The frontend that shows the command's output: "+strings.Join(uiNames(), ", "))
+
+// A ui shows the output of runs, and may ask for reruns.
+type ui interface {
+	redisplay(func(io.Writer))
+	// finished is called with the result of each run once the output
+	// written through redisplay is complete, for frontends that show
+	// results, such as badges, summaries, or a history.
+	finished(r runResult)
+	// An empty struct is sent when the command should be rerun.
+	rerun() <-chan struct{}
+}
+
+// uis are the frontends that can be chosen with -ui, by name. Each
+// frontend registers its constructor here, from an init function if it
+// is in a file of its own.
+var uis = map[string]func() (ui, error){
+	"plain": func() (ui, error) {
+		if *lspMode {
+			// Standard output is the LSP connection.
+			return writerUI{os.Stderr}, nil
+		}
+		return writerUI{os.Stdout}, nil
+	},
+}
+
+// uiNames returns the names of the registered frontends.
+func uiNames() []string {
+	var names []string
+	for name := range uis {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// newUI returns the frontend chosen with -ui.
+func newUI() (ui, error) {
+	f, ok := uis[*uiName]
+	if !ok {
+		return nil, fmt.Errorf("unknown -ui %q; choose from %s", *uiName, strings.Join(uiNames(), ", "))
+	}
+	return f()
+}
+
+// A writerUI writes the output to a writer, and never asks for reruns.
+type writerUI struct{ io.Writer }
+
+func (w writerUI) redisplay(f func(io.Writer)) { f(w) }
+
+func (w writerUI) finished(runResult) {}
+
+func (w writerUI) rerun() <-chan struct{} { return nil }
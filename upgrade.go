@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// upgradePkg is the package built by watch upgrade by default.
+const upgradePkg = "github.com/weaveworks/Watch@latest"
+
+// upgrades receives a value when the session is asked, through the
+// control socket, to replace itself with an upgraded binary.
+var upgrades = make(chan struct{}, 1)
+
+// upgrading is set while the session replaces itself, so that it
+// is not summed up as if it were exiting.
+var upgrading bool
+
+// An upgradeState is the history of a session, handed over to the
+// upgraded binary, which runs with the same pid.
+type upgradeState struct {
+	Pid         int           `json:"pid"`
+	Runs        int           `json:"runs"`
+	Failed      int           `json:"failed"`
+	CommandTime time.Duration `json:"command_time"`
+	Start       time.Time     `json:"start"`
+	// Run is the command's run in progress, if any.
+	Run *handedOffRun `json:"run,omitempty"`
+}
+
+// A handedOffRun is a run of the command handed over to the upgraded
+// binary. The command stays its child, since the pid is the same, and
+// the read ends of its output pipes stay open across the exec.
+type handedOffRun struct {
+	Pid    int       `json:"pid"`
+	Args   []string  `json:"args"`
+	Reason string    `json:"reason"`
+	Line   string    `json:"line,omitempty"`
+	Start  time.Time `json:"start"`
+	Stdout uintptr   `json:"stdout"`
+	Stderr uintptr   `json:"stderr"`
+}
+
+// handOff is closed to have the run in progress handed over to the
+// upgraded binary, rather than stopped.
+var handOff = make(chan struct{})
+
+// handedOff is the run handed over, once it has been, and adopted the
+// run that was handed over to this process, if it was upgraded.
+var handedOff, adopted *handedOffRun
+
+// handedOffFiles are the pipes handed over, kept so that they are not
+// closed when collected before the exec.
+var handedOffFiles []*os.File
+
+// A runOutput copies the command's standard output and error from pipes
+// of Watch's own, rather than ones made by exec, so that their read ends
+// can be handed over on upgrading.
+type runOutput struct {
+	r, w [2]*os.File // the read and write ends of each pipe
+	wg   sync.WaitGroup
+}
+
+// pipeOutput makes the pipes for cmd's output.
+func pipeOutput(cmd *exec.Cmd) (*runOutput, error) {
+	o := &runOutput{}
+	for i := range o.r {
+		var err error
+		if o.r[i], o.w[i], err = os.Pipe(); err != nil {
+			o.close()
+			return nil, err
+		}
+	}
+	cmd.Stdout, cmd.Stderr = o.w[0], o.w[1]
+	return o, nil
+}
+
+// close closes the pipes, when the command failed to start.
+func (o *runOutput) close() {
+	for _, f := range append(o.r[:], o.w[:]...) {
+		if f != nil {
+			f.Close()
+		}
+	}
+}
+
+// copy closes the write ends, which the started command has, and copies
+// its output to stdout and stderr.
+func (o *runOutput) copy(stdout, stderr io.Writer) {
+	for i, w := range []io.Writer{stdout, stderr} {
+		if o.w[i] != nil {
+			o.w[i].Close()
+		}
+		o.wg.Add(1)
+		go func(f *os.File, w io.Writer) {
+			defer o.wg.Done()
+			io.Copy(w, f)
+		}(o.r[i], w)
+	}
+}
+
+// wait waits for the output to end, once the command has exited, and
+// closes the pipes.
+func (o *runOutput) wait() {
+	o.wg.Wait()
+	for _, f := range o.r {
+		f.Close()
+	}
+}
+
+// detach stops copying the output, without closing the pipes, and
+// returns the run to hand over with them.
+func (o *runOutput) detach(r runResult, pid int) *handedOffRun {
+	for _, f := range o.r {
+		f.SetReadDeadline(time.Now())
+	}
+	o.wg.Wait()
+	handedOffFiles = o.r[:]
+	h := &handedOffRun{Pid: pid, Args: r.args, Reason: r.reason, Line: r.line, Start: r.start}
+	h.Stdout, h.Stderr = o.r[0].Fd(), o.r[1].Fd()
+	return h
+}
+
+// adoptRun goes on with the run handed over by the binary this process
+// was before upgrading, copying the output from the pipes it left open
+// and waiting for the command to exit.
+func adoptRun(ctx context.Context, ui ui, h *handedOffRun) runResult {
+	r := runResult{args: h.Args, reason: h.Reason, line: h.Line, start: h.Start}
+	ui.redisplay(func(out io.Writer) {
+		mw := jobOutput(out, filepath.Base(cmdArgs[0]))
+		defer mw.Flush()
+		out = mw
+		if *relPaths {
+			if dir, err := os.Getwd(); err == nil {
+				rw := newRelWriter(out, dir)
+				defer rw.Flush()
+				out = rw
+			}
+		}
+		io.WriteString(out, mw.status(strings.Join(r.args, " ")+", running since before the upgrade")+"\n")
+		p, err := os.FindProcess(h.Pid)
+		if err != nil {
+			io.WriteString(out, mw.status("fatal: "+err.Error())+"\n")
+			r.status, r.firstErr = -1, err.Error()
+			return
+		}
+		o := &runOutput{}
+		for i, fd := range []uintptr{h.Stdout, h.Stderr} {
+			// Nonblocking, so that it can be handed over again.
+			syscall.SetNonblock(int(fd), true)
+			o.r[i] = os.NewFile(fd, "output")
+		}
+		awaitRun(ctx, &r, &exec.Cmd{Path: h.Args[0], Args: h.Args, Process: p}, o, out, mw)
+	})
+	if handedOff != nil {
+		return r
+	}
+	r.end = time.Now()
+	reportFinished(r)
+	ui.finished(r)
+	return r
+}
+
+// upgradeStatePath returns the file holding the upgradeState.
+func upgradeStatePath() string {
+	dir, err := os.Getwd()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(projectStateDir(dir), "upgrade.json")
+}
+
+// reexec replaces the session with the binary now installed in its
+// place, with the same flags and command, and the command's run, if it
+// was handed over. It only returns if that fails.
+func reexec() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if handedOff != nil {
+		for _, fd := range []uintptr{handedOff.Stdout, handedOff.Stderr} {
+			if err := keepOnExec(fd); err != nil {
+				return err
+			}
+		}
+	}
+	st := upgradeState{Pid: os.Getpid(), Runs: runCount, Failed: failCount, CommandTime: commandTime, Start: sessionStart, Run: handedOff}
+	b, _ := json.Marshal(st)
+	p := upgradeStatePath()
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(p, b); err != nil {
+		return err
+	}
+	log.Printf("Upgrading to %s", exe)
+	upgrading = true
+	runCleanups()
+	return syscall.Exec(exe, os.Args, os.Environ())
+}
+
+// resumeSession restores the history of the session this process was
+// before it upgraded, if it was one.
+func resumeSession() {
+	p := upgradeStatePath()
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		return
+	}
+	var st upgradeState
+	if json.Unmarshal(b, &st) != nil || st.Pid != os.Getpid() {
+		return
+	}
+	os.Remove(p)
+	runCount, failCount, commandTime, sessionStart = st.Runs, st.Failed, st.CommandTime, st.Start
+	adopted = st.Run
+	log.Printf("Upgraded after %d runs", runCount)
+}
+
+// keepOnExec clears the close-on-exec flag of fd, which Go sets on
+// all the files it opens.
+func keepOnExec(fd uintptr) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_FCNTL, fd, syscall.F_SETFD, 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// upgradeCmd installs a new Watch binary in place of this one, and asks
+// the session for the working directory to switch to it:
+//
+//	watch upgrade [-from binary] [-pkg package@version]
+func upgradeCmd(args []string) {
+	fs := flag.NewFlagSet("upgrade", flag.ExitOnError)
+	from := fs.String("from", "", "Install this binary rather than building one")
+	pkg := fs.String("pkg", upgradePkg, "The package to build with go install")
+	sock := fs.String("socket", "", "The control socket (default: that of the session for the working directory)")
+	fs.Parse(args)
+
+	exe, err := os.Executable()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	bin := *from
+	if bin == "" {
+		dir, err := ioutil.TempDir("", "watch-upgrade")
+		if err != nil {
+			log.Fatalln(err)
+		}
+		defer os.RemoveAll(dir)
+		cmd := exec.Command("go", "install", *pkg)
+		cmd.Env = append(os.Environ(), "GOBIN="+dir)
+		cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+		if err := cmd.Run(); err != nil {
+			log.Fatalf("Failed to build %s: %s", *pkg, err)
+		}
+		name := strings.SplitN(*pkg, "@", 2)[0]
+		bin = filepath.Join(dir, name[strings.LastIndexByte(name, '/')+1:])
+	}
+	if err := install(bin, exe); err != nil {
+		log.Fatalf("Failed to install %s: %s", bin, err)
+	}
+	fmt.Printf("Installed %s\n", exe)
+
+	if _, err := sendCtl(*sock, ctlRequest{Method: "upgrade", Version: ctlVersion}); err != nil {
+		log.Printf("Not upgrading a session: %s", err)
+	}
+}
+
+// install replaces the binary exe with bin, atomically, so that a
+// session starting meanwhile runs one or the other.
+func install(bin, exe string) error {
+	b, err := ioutil.ReadFile(bin)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(exe), "."+filepath.Base(exe))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(0755); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), exe)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+)
+
+// walkWorkers is the number of directories read at once while walking
+// a tree to watch. Reading them is mostly waiting on the disk.
+const walkWorkers = 16
+
+// A walker finds the directories to watch in a tree, reading them
+// concurrently. It collects them rather than watching them, so that the
+// watches are added together, by one goroutine, once the walk is done.
+type walker struct {
+	// sem holds a token for each directory being read by a goroutine
+	// of its own; when it is full, directories are read in the goroutine
+	// that found them.
+	sem chan struct{}
+
+	// depth is the number of levels of directories below the root to
+	// watch, or 0 for all of them.
+	depth int
+
+	// mu guards the ignore rules, which are loaded as they are found,
+	// dirs, the directories to watch, and lazy, those of them with
+	// directories below them left unwatched for lack of depth.
+	mu   sync.Mutex
+	dirs []string
+	lazy []string
+}
+
+// newWalker returns a walker for the watched directories.
+func newWalker() *walker {
+	return &walker{sem: make(chan struct{}, walkWorkers), depth: *lazyDepth}
+}
+
+// walk adds p, which is level directories below the root, and the
+// directories below it to those to watch, and reports whether it added p.
+// With -i or -g, when prune is set, directories with files of which none
+// match, and nothing below that does either, are skipped. Directories
+// without files are watched, since matching files may be added.
+func (wk *walker) walk(p string, level int, prune bool) bool {
+	ents, err := ioutil.ReadDir(longPath(p))
+	switch {
+	case os.IsNotExist(err):
+		return false
+
+	case err != nil:
+		log.Printf("Failed to watch %s: %s", p, err)
+	}
+
+	wk.mu.Lock()
+	for _, e := range ents {
+		if sub := filepath.Join(p, normName(e.Name())); isIgnoreFile(sub) {
+			loadIgnoreFile(sub)
+		}
+	}
+	wk.mu.Unlock()
+
+	var (
+		files   int
+		matched int32
+		lazy    bool
+		wg      sync.WaitGroup
+	)
+	for _, e := range ents {
+		sub := filepath.Join(p, normName(e.Name()))
+		if excludedBy(sub) != "" {
+			debugPrint("excluding %s", sub)
+			continue
+		}
+		if isUnwatched(sub) {
+			continue
+		}
+		isdir, err := isDir(sub)
+		wk.mu.Lock()
+		rule := ignoredBy(sub, isdir)
+		wk.mu.Unlock()
+		if rule != "" {
+			debugPrint("excluding %s, ignored by %s", sub, rule)
+			continue
+		}
+		switch {
+		case err != nil:
+			log.Printf("Failed to watch %s: %s", sub, err)
+
+		case isdir && wk.depth > 0 && level >= wk.depth:
+			// What is below may match, so do not prune p.
+			lazy = true
+			atomic.StoreInt32(&matched, 1)
+
+		case isdir:
+			select {
+			case wk.sem <- struct{}{}:
+				wg.Add(1)
+				go func(sub string) {
+					defer wg.Done()
+					if wk.walk(sub, level+1, true) {
+						atomic.StoreInt32(&matched, 1)
+					}
+					<-wk.sem
+				}(sub)
+			default:
+				if wk.walk(sub, level+1, true) {
+					atomic.StoreInt32(&matched, 1)
+				}
+			}
+
+		default:
+			files++
+			if hasIncludes() && included(sub) {
+				atomic.StoreInt32(&matched, 1)
+			}
+		}
+	}
+	wg.Wait()
+
+	if prune && hasIncludes() && files > 0 && atomic.LoadInt32(&matched) == 0 {
+		debugPrint("no files in %s match -i or -g", p)
+		return false
+	}
+	wk.mu.Lock()
+	wk.dirs = append(wk.dirs, p)
+	if lazy {
+		wk.lazy = append(wk.lazy, p)
+	}
+	wk.mu.Unlock()
+	return true
+}